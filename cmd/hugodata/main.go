@@ -38,7 +38,7 @@ func fetchPostList(
 	afterKey string,
 ) error {
 
-	postList, err := mpClient.QueryPostList(mpEndpoint, accessToken, afterKey)
+	postList, err := mpClient.QueryPostList(mpEndpoint, accessToken, afterKey, "")
 	if err != nil {
 		return err
 	}
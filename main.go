@@ -1,15 +1,25 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/j4y_funabashi/inari-admin/pkg/cookie"
+	"github.com/j4y_funabashi/inari-admin/pkg/csrf"
+	"github.com/j4y_funabashi/inari-admin/pkg/deleted"
+	"github.com/j4y_funabashi/inari-admin/pkg/gazetteer"
 	"github.com/j4y_funabashi/inari-admin/pkg/google"
 	"github.com/j4y_funabashi/inari-admin/pkg/indieauth"
 	"github.com/j4y_funabashi/inari-admin/pkg/login"
 	"github.com/j4y_funabashi/inari-admin/pkg/micropub"
 	"github.com/j4y_funabashi/inari-admin/pkg/okami"
+	"github.com/j4y_funabashi/inari-admin/pkg/osm"
+	"github.com/j4y_funabashi/inari-admin/pkg/outbox"
 	"github.com/j4y_funabashi/inari-admin/pkg/session"
 	log "github.com/sirupsen/logrus"
 )
@@ -20,32 +30,139 @@ func main() {
 	port := "80"
 	sessionBucketRegion := "eu-central-1"
 	sessionBucket := os.Getenv("SESSION_BUCKET")
+	sessionStoreURL := os.Getenv("SESSION_STORE")
+	sessionKeys := os.Getenv("SESSION_KEYS")
+	cookieKey := os.Getenv("COOKIE_KEY")
+	singleInstance := os.Getenv("OUTBOX_SINGLE_INSTANCE") == "true"
+	if sessionStoreURL == "" {
+		sessionStoreURL = "s3://" + sessionBucket + "?region=" + sessionBucketRegion
+	}
 	clientID := os.Getenv("CLIENT_ID")
 	redirectURL := os.Getenv("CALLBACK_URL")
+	geoProviders := os.Getenv("GEO_PROVIDERS")
 	geoAPIKey := os.Getenv("GEO_API_KEY")
 	geoBaseURL := os.Getenv("GEO_BASE_URL")
+	osmSearchURL := os.Getenv("OSM_SEARCH_URL")
+	osmReverseURL := os.Getenv("OSM_REVERSE_URL")
+	osmUserAgent := os.Getenv("OSM_USER_AGENT")
+	gazetteerDir := os.Getenv("GAZETTEER_DIR")
+	// osm is only on by default once it can be used politely, with a user
+	// agent for the public Nominatim server or a self-hosted server
+	if geoProviders == "" {
+		selfHostedOSM := osmSearchURL != "" && !strings.Contains(osmSearchURL, "nominatim.openstreetmap.org")
+		var providers []string
+		if geoAPIKey != "" {
+			providers = append(providers, "google")
+		}
+		if osmUserAgent != "" || selfHostedOSM {
+			providers = append(providers, "osm")
+		}
+		if gazetteerDir != "" {
+			providers = append(providers, "gazetteer")
+		}
+		geoProviders = strings.Join(providers, ",")
+	}
+	if osmSearchURL == "" {
+		osmSearchURL = "https://nominatim.openstreetmap.org/search"
+	}
+	if osmReverseURL == "" {
+		osmReverseURL = "https://nominatim.openstreetmap.org/reverse"
+	}
 
 	// deps
 	logger := log.New()
 	logger.Formatter = &log.JSONFormatter{}
 
-	sstore, err := session.NewS3SessionStore(sessionBucketRegion, sessionBucket)
+	sstore, err := session.NewSessionStore(sessionStoreURL)
 	if err != nil {
 		logger.WithError(err).Fatal("failed to create session store")
 	}
-	authClient := indieauth.NewClient("", sstore, logger)
+	if sessionKeys != "" {
+		keyring, err := session.ParseKeyring(sessionKeys)
+		if err != nil {
+			logger.WithError(err).Fatal("failed to parse session keys")
+		}
+		sstore = session.NewEncryptedSessionStore(sstore, keyring)
+	} else {
+		logger.Warn("SESSION_KEYS is not set, sessions are stored unencrypted")
+	}
+	// s3 can not stop two instances claiming the same outbox item, so the
+	// deployment has to promise it runs one instance
+	if strings.HasPrefix(sessionStoreURL, "s3:") && !singleInstance {
+		logger.Fatal("the S3 outbox can send a post twice when more than one instance runs, run a single instance and set OUTBOX_SINGLE_INSTANCE=true, or use a sqlite:// SESSION_STORE")
+	}
+	obstore, err := outbox.NewStore(sessionStoreURL)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to create outbox store")
+	}
+	dpstore, err := deleted.NewStore(sessionStoreURL)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to create deleted post store")
+	}
+	if strings.HasPrefix(sessionStoreURL, "memory:") {
+		logger.Warn("SESSION_STORE is memory://, the outbox and deleted posts will not survive restarts")
+	}
+
+	cookieKeyBytes, err := base64.StdEncoding.DecodeString(cookieKey)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to decode cookie key")
+	}
+	if cookieKey == "" {
+		logger.Warn("COOKIE_KEY is not set, everyone is logged out on restart")
+		cookieKeyBytes = make([]byte, cookie.MinKeySize)
+		_, err = rand.Read(cookieKeyBytes)
+		if err != nil {
+			logger.WithError(err).Fatal("failed to generate cookie key")
+		}
+	}
+	cookies, err := cookie.New(cookieKeyBytes, strings.HasPrefix(redirectURL, "https://"))
+	if err != nil {
+		logger.WithError(err).Fatal("failed to create cookie jar")
+	}
+
+	authClient := indieauth.NewClient(sstore, cookies, logger)
 	mpClient := micropub.NewClient(logger)
 
-	geoCoder := google.NewGeocoder(geoAPIKey, geoBaseURL, logger)
+	// geocoders are tried in the configured order
+	var geoCoder micropub.FallbackGeoCoder
+	for _, provider := range strings.Split(geoProviders, ",") {
+		switch strings.TrimSpace(provider) {
+		case "":
+		case "google":
+			geoCoder = append(geoCoder, google.NewGeocoder(geoAPIKey, geoBaseURL, logger))
+		case "osm":
+			publicHost := strings.Contains(osmSearchURL+osmReverseURL, "nominatim.openstreetmap.org")
+			if publicHost && osmUserAgent == "" {
+				logger.Fatal("OSM_USER_AGENT is required by the Nominatim usage policy, set it to the app name and a contact")
+			}
+			geoCoder = append(geoCoder, osm.NewGeocoder(osmSearchURL, osmReverseURL, osmUserAgent, logger))
+		case "gazetteer":
+			if gazetteerDir == "" {
+				logger.Fatal("GAZETTEER_DIR is required by the gazetteer geocoder")
+			}
+			places, err := gazetteer.Open(gazetteerDir)
+			if err != nil {
+				logger.WithError(err).Fatal("failed to load gazetteer")
+			}
+			geoCoder = append(geoCoder, places)
+		default:
+			logger.WithField("provider", provider).Fatal("unknown geocoder")
+		}
+	}
+	if len(geoCoder) == 0 {
+		logger.Warn("GEO_PROVIDERS is not set, location search is off")
+	}
 
 	// routes
 	router := mux.NewRouter()
 	router.Use(newLoggerMiddleware(logger))
+	router.Use(csrf.Middleware(sstore, cookies, logger, "/login-init"))
 
 	// servers
 	loginServer := login.NewServer(
 		logger,
 		authClient,
+		cookies,
 		clientID,
 		redirectURL,
 	)
@@ -59,9 +176,18 @@ func main() {
 		mpClient,
 		geoCoder,
 		app,
+		obstore,
+		dpstore,
+		cookies,
+		authClient,
 	)
 	micropubClientServer.Routes(router)
 
+	// workers
+	outboxWorker := outbox.NewWorker(obstore, micropubClientServer.SendOutboxItem, logger)
+	go outboxWorker.Run(time.Minute)
+	go authClient.RunSessionSweeper(time.Hour)
+
 	logger.Info("server running on port " + port)
 
 	logger.Fatal(http.ListenAndServe(
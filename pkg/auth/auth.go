@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/cookie"
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
+	"github.com/sirupsen/logrus"
+)
+
+// ReasonRevoked is sent to the login page when the access token of a
+// session was revoked
+const ReasonRevoked = "revoked"
+
+// TokenRefresher keeps the access token of a session usable, returning
+// session.ErrTokenRevoked when the user has to log in again
+type TokenRefresher interface {
+	RefreshIfNeeded(usess session.UserSession, now time.Time) (session.UserSession, error)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying usess
+func NewContext(ctx context.Context, usess session.UserSession) context.Context {
+	return context.WithValue(ctx, contextKey{}, usess)
+}
+
+// FromContext returns the session stored in ctx by the middleware
+func FromContext(ctx context.Context) (session.UserSession, bool) {
+	usess, ok := ctx.Value(contextKey{}).(session.UserSession)
+	return usess, ok
+}
+
+// CurrentSession returns the session of a request that went through the
+// middleware
+func CurrentSession(r *http.Request) session.UserSession {
+	usess, _ := FromContext(r.Context())
+	return usess
+}
+
+// Middleware resolves the session cookie to a UserSession and stores it in
+// the request context, browsers without a session are sent to the login
+// page and API clients get a JSON 401
+func Middleware(store session.SessionStore, cookies cookie.Jar, tokens TokenRefresher, logger *logrus.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			// fetch cookie, the first session is the site being posted to
+			sessionIDs, err := cookies.SessionIDs(r)
+			if err != nil {
+				logger.WithError(err).Info("could not find sessionid cookie")
+				unauthorized(w, r, "")
+				return
+			}
+
+			// fetch session
+			usess, err := store.FetchByID(sessionIDs[0])
+			if err != nil {
+				logger.WithError(err).Info("could not find session")
+				unauthorized(w, r, "")
+				return
+			}
+			if usess.AccessToken == "" {
+				logger.WithField("me", usess.Me).Info("session has not finished logging in")
+				unauthorized(w, r, "")
+				return
+			}
+
+			// fetch the other sites this browser is logged in to
+			others := session.FetchAccounts(store, sessionIDs[1:])
+			for _, other := range others {
+				usess.OtherAccounts = append(usess.OtherAccounts, other.Account())
+			}
+
+			// refresh the access token before it is used
+			usess, err = tokens.RefreshIfNeeded(usess, time.Now())
+			if err == session.ErrTokenRevoked {
+				logger.WithField("me", usess.Me).Info("logging out session with revoked token")
+				err = store.Delete(usess.Uid)
+				if err != nil {
+					logger.WithError(err).Error("failed to delete session")
+				}
+				// the other sites stay logged in
+				ids, expiresAt := session.AccountIDs(others)
+				w.Header().Set("Set-Cookie", cookies.SessionsCookie(ids, expiresAt, time.Now()))
+				unauthorized(w, r, ReasonRevoked)
+				return
+			}
+			if err != nil {
+				logger.WithError(err).Error("failed to refresh access token")
+			}
+			logger.WithFields(logrus.Fields{"user": usess.Me}).Info("logged in user")
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), usess)))
+		})
+	}
+}
+
+// LoginURL is the login page that sends the user back to returnTo once
+// they have logged in, reason explains why they have to log in again
+func LoginURL(returnTo, reason string) string {
+	q := url.Values{}
+	returnTo = SafeReturnTo(returnTo)
+	if returnTo != "" {
+		q.Set("return_to", returnTo)
+	}
+	if reason != "" {
+		q.Set("reason", reason)
+	}
+	if len(q) == 0 {
+		return "/login"
+	}
+	return "/login?" + q.Encode()
+}
+
+// SafeReturnTo only allows paths on this site so the login page can not be
+// used to redirect to another site
+func SafeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") ||
+		strings.HasPrefix(returnTo, "//") ||
+		strings.HasPrefix(returnTo, "/\\") {
+		return ""
+	}
+	u, err := url.Parse(returnTo)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return ""
+	}
+	return returnTo
+}
+
+// WantsJSON is true for requests made by scripts rather than browsers
+func WantsJSON(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, reason string) {
+	if WantsJSON(r) {
+		errorResponse := map[string]string{
+			"error":             "unauthorized",
+			"error_description": "log in to continue",
+		}
+		if reason == ReasonRevoked {
+			errorResponse["error"] = "invalid_token"
+			errorResponse["error_description"] = "the access token was revoked, log in again"
+		}
+		body, _ := json.Marshal(errorResponse)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(body)
+		return
+	}
+
+	// only pages that can be loaded again are returned to after login
+	returnTo := ""
+	if r.Method == "GET" || r.Method == "HEAD" {
+		returnTo = r.URL.RequestURI()
+	}
+	w.Header().Set("Location", LoginURL(returnTo, reason))
+	w.WriteHeader(http.StatusSeeOther)
+}
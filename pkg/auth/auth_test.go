@@ -0,0 +1,277 @@
+package auth_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/auth"
+	"github.com/j4y_funabashi/inari-admin/pkg/cookie"
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
+	"github.com/matryer/is"
+	"github.com/sirupsen/logrus"
+)
+
+type stubRefresher struct {
+	err error
+}
+
+func (r stubRefresher) RefreshIfNeeded(usess session.UserSession, now time.Time) (session.UserSession, error) {
+	if r.err == nil {
+		usess.AccessToken = "refreshed-token"
+	}
+	return usess, r.err
+}
+
+func TestMiddleware(t *testing.T) {
+
+	jar, err := cookie.New(bytes.Repeat([]byte{1}, cookie.MinKeySize), true)
+	if err != nil {
+		t.Fatalf("failed to create jar: %s", err.Error())
+	}
+
+	var tests = []struct {
+		name             string
+		method           string
+		target           string
+		accept           string
+		sessionID        string
+		refreshErr       error
+		expectedStatus   int
+		expectedLocation string
+		expectedBody     string
+	}{
+		{
+			name:           "logged in",
+			method:         "GET",
+			target:         "/composer",
+			sessionID:      "session-1",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "https://example.com/",
+		},
+		{
+			name:             "browser without cookie",
+			method:           "GET",
+			target:           "/queryposts?post-status=draft",
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "/login?return_to=%2Fqueryposts%3Fpost-status%3Ddraft",
+		},
+		{
+			name:             "browser with expired session",
+			method:           "GET",
+			target:           "/outbox",
+			sessionID:        "expired-1",
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "/login?return_to=%2Foutbox",
+		},
+		{
+			name:             "browser posting a form",
+			method:           "POST",
+			target:           "/submit",
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "/login",
+		},
+		{
+			name:             "revoked token",
+			method:           "GET",
+			target:           "/composer",
+			sessionID:        "session-1",
+			refreshErr:       session.ErrTokenRevoked,
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "/login?reason=revoked&return_to=%2Fcomposer",
+		},
+		{
+			name:           "api client with revoked token",
+			method:         "GET",
+			target:         "/composer/media/gallery",
+			accept:         "application/json",
+			sessionID:      "session-1",
+			refreshErr:     session.ErrTokenRevoked,
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   `{"error":"invalid_token","error_description":"the access token was revoked, log in again"}`,
+		},
+		{
+			name:           "api client",
+			method:         "GET",
+			target:         "/composer/media/gallery",
+			accept:         "application/json",
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   `{"error":"unauthorized","error_description":"log in to continue"}`,
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			now := time.Now()
+			store := session.NewMemorySessionStore()
+			is.NoErr(store.Create(session.UserSession{
+				Uid:         "session-1",
+				Me:          "https://example.com/",
+				AccessToken: "token",
+				ExpiresAt:   now.Add(time.Hour),
+			}))
+			is.NoErr(store.Create(session.UserSession{
+				Uid:         "expired-1",
+				Me:          "https://example.com/",
+				AccessToken: "token",
+				ExpiresAt:   now.Add(-time.Hour),
+			}))
+			logger := logrus.New()
+			logger.Out = ioutil.Discard
+			handler := auth.Middleware(store, jar, stubRefresher{err: tt.refreshErr}, logger)(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					usess := auth.CurrentSession(r)
+					w.Write([]byte(usess.Me))
+					is.Equal(usess.AccessToken, "refreshed-token")
+				}),
+			)
+
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if tt.sessionID != "" {
+				r.AddCookie(&http.Cookie{Name: cookie.Name, Value: jar.Sign(tt.sessionID)})
+			}
+			w := httptest.NewRecorder()
+
+			// act
+			handler.ServeHTTP(w, r)
+
+			// assert
+			is.Equal(w.Code, tt.expectedStatus)
+			is.Equal(w.Header().Get("Location"), tt.expectedLocation)
+			if tt.expectedBody != "" {
+				is.Equal(w.Body.String(), tt.expectedBody)
+			}
+			if tt.refreshErr == session.ErrTokenRevoked {
+				is.Equal(w.Header().Get("Set-Cookie"), jar.ClearCookie())
+				_, err := store.FetchByID(tt.sessionID)
+				is.True(err != nil)
+			}
+		})
+	}
+}
+
+func TestSafeReturnTo(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		returnTo string
+		expected string
+	}{
+		{name: "local path", returnTo: "/edit?url=https%3A%2F%2Fexample.com%2F1", expected: "/edit?url=https%3A%2F%2Fexample.com%2F1"},
+		{name: "empty", returnTo: "", expected: ""},
+		{name: "absolute url", returnTo: "https://evil.example/", expected: ""},
+		{name: "protocol relative url", returnTo: "//evil.example/", expected: ""},
+		{name: "backslash", returnTo: "/\\evil.example/", expected: ""},
+		{name: "relative path", returnTo: "composer", expected: ""},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			result := auth.SafeReturnTo(tt.returnTo)
+
+			// assert
+			is.Equal(result, tt.expected)
+		})
+	}
+}
+
+func TestMiddlewareAccounts(t *testing.T) {
+
+	jar, err := cookie.New(bytes.Repeat([]byte{1}, cookie.MinKeySize), true)
+	if err != nil {
+		t.Fatalf("failed to create jar: %s", err.Error())
+	}
+
+	var tests = []struct {
+		name           string
+		refreshErr     error
+		expectedStatus int
+		expectedCookie []string
+	}{
+		{
+			name:           "lists the other sites",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "revoked token keeps the other sites",
+			refreshErr:     session.ErrTokenRevoked,
+			expectedStatus: http.StatusSeeOther,
+			expectedCookie: []string{"session-2"},
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			now := time.Now()
+			store := session.NewMemorySessionStore()
+			is.NoErr(store.Create(session.UserSession{
+				Uid:         "session-1",
+				Me:          "https://example.com/",
+				AccessToken: "token",
+				ExpiresAt:   now.Add(time.Hour),
+			}))
+			is.NoErr(store.Create(session.UserSession{
+				Uid:         "session-2",
+				Me:          "https://blog.example.org/",
+				AccessToken: "token",
+				HCard:       session.HCard{Name: "Blog"},
+				ExpiresAt:   now.Add(2 * time.Hour),
+			}))
+			logger := logrus.New()
+			logger.Out = ioutil.Discard
+			var accounts session.Accounts
+			handler := auth.Middleware(store, jar, stubRefresher{err: tt.refreshErr}, logger)(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					accounts = auth.CurrentSession(r).Accounts()
+				}),
+			)
+
+			r := httptest.NewRequest("GET", "/composer", nil)
+			r.Header.Set("Cookie", strings.Split(
+				jar.SessionsCookie([]string{"session-1", "missing", "session-2"}, now.Add(time.Hour), now),
+				";",
+			)[0])
+			w := httptest.NewRecorder()
+
+			// act
+			handler.ServeHTTP(w, r)
+
+			// assert
+			is.Equal(w.Code, tt.expectedStatus)
+			if tt.refreshErr == nil {
+				is.Equal(accounts.Current.Host(), "example.com")
+				is.Equal(accounts.Others, []session.Account{
+					{Me: "https://blog.example.org/", Name: "Blog"},
+				})
+				return
+			}
+			set := httptest.NewRequest("GET", "/composer", nil)
+			set.Header.Set("Cookie", strings.Split(w.Header().Get("Set-Cookie"), ";")[0])
+			sessionIDs, err := jar.SessionIDs(set)
+			is.NoErr(err)
+			is.Equal(sessionIDs, tt.expectedCookie)
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package cookie
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Name is the name of the session cookie
+const Name = "sessionid"
+
+// MinKeySize is the smallest signing key that is accepted
+const MinKeySize = 32
+
+// separator joins the session ids of a browser logged in to several sites
+const separator = ":"
+
+// ErrInvalidSignature is returned for cookies that were not signed by us
+var ErrInvalidSignature = errors.New("invalid cookie signature")
+
+// Jar signs session cookies so a session id can only be used as a cookie
+// if it was issued by this server
+type Jar struct {
+	key    []byte
+	secure bool
+}
+
+// New creates a jar signing with key, secure cookies are only sent over
+// https
+func New(key []byte, secure bool) (Jar, error) {
+	if len(key) < MinKeySize {
+		return Jar{}, fmt.Errorf("cookie key must be at least %d bytes", MinKeySize)
+	}
+	return Jar{key: key, secure: secure}, nil
+}
+
+// Sign appends an HMAC of value to value
+func (j Jar) Sign(value string) string {
+	return value + "." + j.mac(value)
+}
+
+// Verify checks the signature of signed and returns the original value
+func (j Jar) Verify(signed string) (string, error) {
+	i := strings.LastIndex(signed, ".")
+	if i < 1 {
+		return "", ErrInvalidSignature
+	}
+	value, mac := signed[:i], signed[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(j.mac(value))) {
+		return "", ErrInvalidSignature
+	}
+	return value, nil
+}
+
+func (j Jar) mac(value string) string {
+	h := hmac.New(sha256.New, j.key)
+	h.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// SessionID reads and verifies the session cookie of r, returning the id
+// of the active session
+func (j Jar) SessionID(r *http.Request) (string, error) {
+	sessionIDs, err := j.SessionIDs(r)
+	if err != nil {
+		return "", err
+	}
+	return sessionIDs[0], nil
+}
+
+// SessionIDs reads and verifies the session cookie of r, returning the ids
+// of every session in the browser with the active session first
+func (j Jar) SessionIDs(r *http.Request) ([]string, error) {
+	c, err := r.Cookie(Name)
+	if err != nil {
+		return nil, err
+	}
+	value, err := j.Verify(c.Value)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(value, separator), nil
+}
+
+// SessionCookie is the Set-Cookie header value for a signed sessionID
+// that expires at expiresAt
+func (j Jar) SessionCookie(sessionID string, expiresAt, now time.Time) string {
+	return j.SessionsCookie([]string{sessionID}, expiresAt, now)
+}
+
+// SessionsCookie is the Set-Cookie header value for a browser logged in to
+// several sites, the first session is the active one
+func (j Jar) SessionsCookie(sessionIDs []string, expiresAt, now time.Time) string {
+	maxAge := int(expiresAt.Sub(now).Seconds())
+	if len(sessionIDs) == 0 || maxAge < 1 {
+		return j.ClearCookie()
+	}
+	return j.build(j.Sign(strings.Join(sessionIDs, separator)), maxAge, expiresAt)
+}
+
+// ClearCookie is the Set-Cookie header value that removes the session
+// cookie
+func (j Jar) ClearCookie() string {
+	return j.build("", 0, time.Unix(0, 0))
+}
+
+// build writes the header by hand as http.Cookie can not set SameSite on
+// older go versions
+func (j Jar) build(value string, maxAge int, expiresAt time.Time) string {
+	parts := []string{
+		Name + "=" + value,
+		"Path=/",
+		"Expires=" + expiresAt.UTC().Format(http.TimeFormat),
+		fmt.Sprintf("Max-Age=%d", maxAge),
+		"HttpOnly",
+		"SameSite=Lax",
+	}
+	if j.secure {
+		parts = append(parts, "Secure")
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,150 @@
+package cookie_test
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/cookie"
+	"github.com/matryer/is"
+)
+
+func newJar(t *testing.T, fill byte, secure bool) cookie.Jar {
+	jar, err := cookie.New(bytes.Repeat([]byte{fill}, cookie.MinKeySize), secure)
+	if err != nil {
+		t.Fatalf("failed to create jar: %s", err.Error())
+	}
+	return jar
+}
+
+func TestVerify(t *testing.T) {
+
+	jar := newJar(t, 1, true)
+	otherJar := newJar(t, 2, true)
+	signed := jar.Sign("session-1")
+
+	var tests = []struct {
+		name     string
+		value    string
+		expected string
+		isValid  bool
+	}{
+		{name: "signed value", value: signed, expected: "session-1", isValid: true},
+		{name: "unsigned value", value: "session-1", isValid: false},
+		{name: "tampered value", value: strings.Replace(signed, "session-1", "session-2", 1), isValid: false},
+		{name: "signed by another key", value: otherJar.Sign("session-1"), isValid: false},
+		{name: "empty", value: "", isValid: false},
+		{name: "only a signature", value: "." + strings.Split(signed, ".")[1], isValid: false},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			result, err := jar.Verify(tt.value)
+
+			// assert
+			is.Equal(err == nil, tt.isValid)
+			is.Equal(result, tt.expected)
+		})
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name     string
+		secure   bool
+		expected string
+	}{
+		{
+			name:     "secure",
+			secure:   true,
+			expected: "Path=/; Expires=Wed, 01 May 2019 13:00:00 GMT; Max-Age=3600; HttpOnly; SameSite=Lax; Secure",
+		},
+		{
+			name:     "insecure for local development",
+			secure:   false,
+			expected: "Path=/; Expires=Wed, 01 May 2019 13:00:00 GMT; Max-Age=3600; HttpOnly; SameSite=Lax",
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			jar := newJar(t, 1, tt.secure)
+
+			// act
+			result := jar.SessionCookie("session-1", now.Add(time.Hour), now)
+
+			// assert
+			is.Equal(result, "sessionid="+jar.Sign("session-1")+"; "+tt.expected)
+		})
+	}
+}
+
+func TestSessionID(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	jar := newJar(t, 1, true)
+	r, _ := http.NewRequest("GET", "/composer", nil)
+	r.AddCookie(&http.Cookie{Name: cookie.Name, Value: jar.Sign("session-1")})
+	unsigned, _ := http.NewRequest("GET", "/composer", nil)
+	unsigned.AddCookie(&http.Cookie{Name: cookie.Name, Value: "session-1"})
+
+	// act
+	result, err := jar.SessionID(r)
+	_, unsignedErr := jar.SessionID(unsigned)
+
+	// assert
+	is.NoErr(err)
+	is.Equal(result, "session-1")
+	is.Equal(unsignedErr, cookie.ErrInvalidSignature)
+}
+
+func TestNewRejectsShortKeys(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// act
+	_, err := cookie.New([]byte("too-short"), true)
+
+	// assert
+	is.True(err != nil)
+}
+
+func TestSessionIDs(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	jar := newJar(t, 1, true)
+	header := jar.SessionsCookie([]string{"session-2", "session-1"}, now.Add(time.Hour), now)
+	r, _ := http.NewRequest("GET", "/composer", nil)
+	r.Header.Set("Cookie", strings.Split(header, ";")[0])
+
+	// act
+	sessionIDs, err := jar.SessionIDs(r)
+	active, activeErr := jar.SessionID(r)
+
+	// assert
+	is.NoErr(err)
+	is.Equal(sessionIDs, []string{"session-2", "session-1"})
+	is.NoErr(activeErr)
+	is.Equal(active, "session-2")
+	is.Equal(jar.SessionsCookie(nil, now.Add(time.Hour), now), jar.ClearCookie())
+}
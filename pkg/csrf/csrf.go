@@ -0,0 +1,117 @@
+package csrf
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/cookie"
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
+	"github.com/sirupsen/logrus"
+)
+
+// FieldName is the name of the form field holding the token
+const FieldName = "csrf_token"
+
+// HeaderName is the header holding the token for requests that are not
+// form posts
+const HeaderName = "X-CSRF-Token"
+
+// Middleware rejects unsafe requests made with a session cookie that do not
+// carry the CSRF token of that session, requests to exempt paths and
+// requests without a session are passed through untouched
+func Middleware(store session.SessionStore, cookies cookie.Jar, logger *logrus.Logger, exempt ...string) func(http.Handler) http.Handler {
+	exemptPaths := make(map[string]bool)
+	for _, path := range exempt {
+		exemptPaths[path] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if exemptPaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			sessionid, err := cookies.SessionID(r)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			usess, err := store.FetchByID(sessionid)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if isSafe(r.Method) {
+				// sessions created before tokens were added get one the
+				// next time they load a page
+				if usess.CSRFToken == "" {
+					err = usess.NewCSRFToken()
+					if err == nil {
+						err = store.Create(usess)
+					}
+					if err != nil {
+						logger.WithError(err).Error("failed to create csrf token")
+					}
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token := r.Header.Get(HeaderName)
+			if token == "" {
+				token = r.PostFormValue(FieldName)
+			}
+			if !Valid(usess.CSRFToken, token) {
+				logger.
+					WithField("path", r.URL.Path).
+					WithField("user", usess.Me).
+					Warn("rejected request with invalid csrf token")
+				renderError(w)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Valid checks token against the token of the session in constant time
+func Valid(expected, token string) bool {
+	if expected == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+func isSafe(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+func renderError(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+
+	t, err := template.ParseFiles(
+		"view/components.html",
+		"view/layout.html",
+		"view/csrf.html",
+	)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("This form has expired, go back, reload the page and try again"))
+		return
+	}
+
+	outBuf := new(bytes.Buffer)
+	v := struct{ PageTitle string }{PageTitle: "Form expired"}
+	t.ExecuteTemplate(outBuf, "layout", v)
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(outBuf.Bytes())
+}
@@ -0,0 +1,142 @@
+package csrf_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/cookie"
+	"github.com/j4y_funabashi/inari-admin/pkg/csrf"
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
+	"github.com/matryer/is"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMiddleware(t *testing.T) {
+
+	jar, err := cookie.New(bytes.Repeat([]byte{1}, cookie.MinKeySize), true)
+	if err != nil {
+		t.Fatalf("failed to create jar: %s", err.Error())
+	}
+
+	var tests = []struct {
+		name           string
+		method         string
+		path           string
+		hasSession     bool
+		formToken      string
+		headerToken    string
+		expectedStatus int
+	}{
+		{name: "form with token", method: "POST", path: "/submit", hasSession: true, formToken: "token-1", expectedStatus: http.StatusOK},
+		{name: "header with token", method: "POST", path: "/submit", hasSession: true, headerToken: "token-1", expectedStatus: http.StatusOK},
+		{name: "missing token", method: "POST", path: "/submit", hasSession: true, expectedStatus: http.StatusForbidden},
+		{name: "wrong token", method: "POST", path: "/submit", hasSession: true, formToken: "token-2", expectedStatus: http.StatusForbidden},
+		{name: "get without token", method: "GET", path: "/composer", hasSession: true, expectedStatus: http.StatusOK},
+		{name: "exempt path", method: "POST", path: "/login-init", hasSession: true, expectedStatus: http.StatusOK},
+		{name: "no session", method: "POST", path: "/submit", expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			store := session.NewMemorySessionStore()
+			is.NoErr(store.Create(session.UserSession{
+				Uid:       "session-1",
+				CSRFToken: "token-1",
+				ExpiresAt: time.Now().Add(time.Hour),
+			}))
+			logger := logrus.New()
+			logger.Out = ioutil.Discard
+			handler := csrf.Middleware(store, jar, logger, "/login-init")(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				}),
+			)
+
+			form := url.Values{}
+			if tt.formToken != "" {
+				form.Set(csrf.FieldName, tt.formToken)
+			}
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.headerToken != "" {
+				r.Header.Set(csrf.HeaderName, tt.headerToken)
+			}
+			if tt.hasSession {
+				r.AddCookie(&http.Cookie{Name: cookie.Name, Value: jar.Sign("session-1")})
+			}
+			w := httptest.NewRecorder()
+
+			// act
+			handler.ServeHTTP(w, r)
+
+			// assert
+			is.Equal(w.Code, tt.expectedStatus)
+		})
+	}
+}
+
+func TestMiddlewareAddsMissingToken(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	jar, err := cookie.New(bytes.Repeat([]byte{1}, cookie.MinKeySize), true)
+	is.NoErr(err)
+	store := session.NewMemorySessionStore()
+	is.NoErr(store.Create(session.UserSession{
+		Uid:       "session-1",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}))
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	handler := csrf.Middleware(store, jar, logger)(http.NotFoundHandler())
+	r := httptest.NewRequest("GET", "/composer", nil)
+	r.AddCookie(&http.Cookie{Name: cookie.Name, Value: jar.Sign("session-1")})
+
+	// act
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	// assert
+	usess, err := store.FetchByID("session-1")
+	is.NoErr(err)
+	is.True(usess.CSRFToken != "")
+}
+
+func TestValid(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		expected string
+		token    string
+		isValid  bool
+	}{
+		{name: "matching", expected: "token-1", token: "token-1", isValid: true},
+		{name: "different", expected: "token-1", token: "token-2", isValid: false},
+		{name: "session without token", expected: "", token: "", isValid: false},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			result := csrf.Valid(tt.expected, tt.token)
+
+			// assert
+			is.Equal(result, tt.isValid)
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package deleted
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// MaxPosts is how many recently deleted posts are remembered for a site
+const MaxPosts = 20
+
+// Post is a post that was deleted from the site Me and can still be
+// undeleted
+type Post struct {
+	Me        string    `json:"me"`
+	URL       string    `json:"url"`
+	Summary   string    `json:"summary"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// Store keeps the deleted posts of each site, so everyone posting to the
+// site sees them whichever browser deleted the post
+type Store interface {
+	Save(post Post) error
+	// List returns the deleted posts of the site me in any order
+	List(me string) ([]Post, error)
+	Delete(me, postURL string) error
+}
+
+// Add remembers post, forgetting the oldest posts of the site once there
+// are more than MaxPosts
+func Add(store Store, post Post) error {
+	err := store.Save(post)
+	if err != nil {
+		return err
+	}
+	posts, err := store.List(post.Me)
+	if err != nil {
+		return err
+	}
+	sortNewestFirst(posts)
+	for i := MaxPosts; i < len(posts); i++ {
+		err = store.Delete(posts[i].Me, posts[i].URL)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recent returns the deleted posts of the site me, newest first
+func Recent(store Store, me string) ([]Post, error) {
+	posts, err := store.List(me)
+	if err != nil {
+		return nil, err
+	}
+	sortNewestFirst(posts)
+	if len(posts) > MaxPosts {
+		posts = posts[:MaxPosts]
+	}
+	return posts, nil
+}
+
+func sortNewestFirst(posts []Post) {
+	sort.Slice(posts, func(a, b int) bool {
+		return posts[a].DeletedAt.After(posts[b].DeletedAt)
+	})
+}
+
+// key hashes a url so it can be used as a file name or object key
+func key(u string) string {
+	sum := sha256.Sum256([]byte(u))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewStore creates a deleted post store from the same URL as the session
+// store, so deleted posts are kept next to the sessions and the outbox:
+//
+//	s3://bucket?region=eu-central-1
+//	file:///var/lib/inari-admin/sessions
+//	sqlite:///var/lib/inari-admin/sessions.db
+//	memory://
+func NewStore(storeURL string) (Store, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse deleted post store url: %v", err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		region := u.Query().Get("region")
+		if region == "" {
+			region = "eu-central-1"
+		}
+		return NewS3Store(region, u.Host)
+	case "file":
+		return NewFileStore(filepath.Join(u.Host+u.Path, "deleted"))
+	case "sqlite":
+		return NewSQLiteStore(u.Host + u.Path)
+	case "memory":
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown deleted post store %q", u.Scheme)
+}
+
+type memoryStore struct {
+	mu    *sync.Mutex
+	posts map[string]map[string]Post
+}
+
+func NewMemoryStore() Store {
+	return memoryStore{
+		mu:    &sync.Mutex{},
+		posts: make(map[string]map[string]Post),
+	}
+}
+
+func (s memoryStore) Save(post Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.posts[post.Me] == nil {
+		s.posts[post.Me] = make(map[string]Post)
+	}
+	s.posts[post.Me][post.URL] = post
+	return nil
+}
+
+func (s memoryStore) List(me string) ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Post
+	for _, post := range s.posts[me] {
+		out = append(out, post)
+	}
+	return out, nil
+}
+
+func (s memoryStore) Delete(me, postURL string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.posts[me], postURL)
+	return nil
+}
+
+type fileStore struct {
+	dir string
+}
+
+// NewFileStore keeps each deleted post as a json file in a directory per
+// site under dir
+func NewFileStore(dir string) (Store, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fileStore{}, err
+	}
+	return fileStore{dir: dir}, nil
+}
+
+func (s fileStore) siteDir(me string) string {
+	return filepath.Join(s.dir, key(me))
+}
+
+func (s fileStore) Save(post Post) error {
+	data, err := json.Marshal(post)
+	if err != nil {
+		return fmt.Errorf("failed to encode json %v", err)
+	}
+	dir := s.siteDir(post.Me)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file first so a crash never leaves half a post
+	tmp, err := ioutil.TempFile(dir, "post")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, key(post.URL)+".json"))
+}
+
+// List skips and logs posts that can not be read so one bad file does
+// not hide the rest
+func (s fileStore) List(me string) ([]Post, error) {
+	paths, err := filepath.Glob(filepath.Join(s.siteDir(me), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var posts []Post
+	for _, path := range paths {
+		var post Post
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("failed to read deleted post [%s][%s]", path, err.Error())
+			continue
+		}
+		err = json.Unmarshal(data, &post)
+		if err != nil {
+			log.Printf("failed to decode deleted post [%s][%s]", path, err.Error())
+			continue
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+func (s fileStore) Delete(me, postURL string) error {
+	err := os.Remove(filepath.Join(s.siteDir(me), key(postURL)+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore keeps deleted posts in a sqlite database at path,
+// creating it if needed, it can share a database with the session store
+func NewSQLiteStore(path string) (Store, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return sqliteStore{}, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS deleted_posts (
+		me TEXT NOT NULL,
+		url TEXT NOT NULL,
+		data TEXT NOT NULL,
+		PRIMARY KEY (me, url)
+	)`)
+	if err != nil {
+		db.Close()
+		return sqliteStore{}, err
+	}
+	return sqliteStore{db: db}, nil
+}
+
+func (s sqliteStore) Save(post Post) error {
+	data, err := json.Marshal(post)
+	if err != nil {
+		return fmt.Errorf("failed to encode json %v", err)
+	}
+	_, err = s.db.Exec(
+		"INSERT OR REPLACE INTO deleted_posts (me, url, data) VALUES (?, ?, ?)",
+		post.Me,
+		post.URL,
+		string(data),
+	)
+	return err
+}
+
+func (s sqliteStore) List(me string) ([]Post, error) {
+	rows, err := s.db.Query("SELECT url, data FROM deleted_posts WHERE me = ?", me)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var post Post
+		var postURL, data string
+		err = rows.Scan(&postURL, &data)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(data), &post)
+		if err != nil {
+			log.Printf("failed to decode deleted post [%s][%s]", postURL, err.Error())
+			continue
+		}
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+func (s sqliteStore) Delete(me, postURL string) error {
+	_, err := s.db.Exec("DELETE FROM deleted_posts WHERE me = ? AND url = ?", me, postURL)
+	return err
+}
+
+type s3Store struct {
+	client     *s3.S3
+	downloader *s3manager.Downloader
+	uploader   *s3manager.Uploader
+	bucket     string
+}
+
+const s3Prefix = "deleted/"
+
+func NewS3Store(region, bucket string) (Store, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	if err != nil {
+		return s3Store{}, err
+	}
+	return s3Store{
+		client:     s3.New(sess),
+		downloader: s3manager.NewDownloader(sess),
+		uploader:   s3manager.NewUploader(sess),
+		bucket:     bucket,
+	}, nil
+}
+
+func (s s3Store) siteKey(me string) string {
+	return s3Prefix + key(me) + "/"
+}
+
+func (s s3Store) Save(post Post) error {
+	data := new(bytes.Buffer)
+	err := json.NewEncoder(data).Encode(post)
+	if err != nil {
+		return fmt.Errorf("failed to encode json %v", err)
+	}
+
+	_, err = s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.siteKey(post.Me) + key(post.URL) + ".json"),
+		Body:   data,
+		ACL:    aws.String("private"),
+	})
+	return err
+}
+
+// List only lists the objects of the site me, posts that can not be read
+// are logged and skipped
+func (s s3Store) List(me string) ([]Post, error) {
+	var keys []string
+	err := s.client.ListObjectsV2Pages(
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(s.siteKey(me)),
+		},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				keys = append(keys, *obj.Key)
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var posts []Post
+	for _, k := range keys {
+		var post Post
+		buf := aws.NewWriteAtBuffer([]byte{})
+		_, err := s.downloader.Download(buf, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(k),
+		})
+		if err != nil {
+			log.Printf("failed to download deleted post [%s][%s]", k, err.Error())
+			continue
+		}
+		err = json.Unmarshal(buf.Bytes(), &post)
+		if err != nil {
+			log.Printf("failed to decode deleted post [%s][%s]", k, err.Error())
+			continue
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+func (s s3Store) Delete(me, postURL string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.siteKey(me) + key(postURL) + ".json"),
+	})
+	return err
+}
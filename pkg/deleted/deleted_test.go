@@ -0,0 +1,158 @@
+package deleted_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/deleted"
+	"github.com/matryer/is"
+)
+
+func TestStores(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deleted")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		name     string
+		storeURL string
+	}{
+		{name: "memory", storeURL: "memory://"},
+		{name: "file", storeURL: "file://" + filepath.Join(dir, "files")},
+		{name: "sqlite", storeURL: "sqlite://" + filepath.Join(dir, "sessions.db")},
+	}
+
+	for _, tt := range tests {
+
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			store, err := deleted.NewStore(tt.storeURL)
+			if err != nil {
+				t.Fatalf("failed to create store: %s", err.Error())
+			}
+
+			// act + assert
+			testStore(t, store)
+		})
+	}
+}
+
+func TestNewStoreUnknownScheme(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// act
+	_, err := deleted.NewStore("redis://localhost")
+
+	// assert
+	is.True(err != nil)
+}
+
+func TestFileStoreSkipsBadPosts(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	dir, err := ioutil.TempDir("", "deleted")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	store, err := deleted.NewFileStore(dir)
+	is.NoErr(err)
+	me := "https://example.com/"
+	post := deleted.Post{Me: me, URL: "https://example.com/1", DeletedAt: time.Now()}
+	is.NoErr(store.Save(post))
+	siteDirs, err := filepath.Glob(filepath.Join(dir, "*"))
+	is.NoErr(err)
+	is.Equal(len(siteDirs), 1)
+	is.NoErr(ioutil.WriteFile(filepath.Join(siteDirs[0], "corrupt.json"), []byte(`{"url":`), 0600))
+
+	// act
+	result, err := deleted.Recent(store, me)
+
+	// assert
+	is.NoErr(err)
+	is.Equal(len(result), 1)
+	is.Equal(result[0].URL, post.URL)
+}
+
+// testStore checks the behaviour every Store must have
+func testStore(t *testing.T, store deleted.Store) {
+
+	is := is.NewRelaxed(t)
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	me := "https://example.com/"
+	older := deleted.Post{Me: me, URL: "https://example.com/1", Summary: "first", DeletedAt: now}
+	newer := deleted.Post{Me: me, URL: "https://example.com/2", Summary: "second", DeletedAt: now.Add(time.Minute)}
+	other := deleted.Post{Me: "https://other.example.com/", URL: "https://other.example.com/1", DeletedAt: now}
+
+	t.Run("a site with no deleted posts has none", func(t *testing.T) {
+		result, err := deleted.Recent(store, me)
+		is.NoErr(err)
+		is.Equal(len(result), 0)
+	})
+
+	t.Run("deleted posts are listed newest first for their site only", func(t *testing.T) {
+		is.NoErr(deleted.Add(store, older))
+		is.NoErr(deleted.Add(store, newer))
+		is.NoErr(deleted.Add(store, other))
+		result, err := deleted.Recent(store, me)
+		is.NoErr(err)
+		is.Equal(len(result), 2)
+		is.Equal(result[0].URL, newer.URL)
+		is.Equal(result[0].Summary, "second")
+		is.True(result[0].DeletedAt.Equal(newer.DeletedAt))
+		is.Equal(result[1].URL, older.URL)
+	})
+
+	t.Run("deleting a post again moves it to the top", func(t *testing.T) {
+		again := older
+		again.DeletedAt = now.Add(time.Hour)
+		is.NoErr(deleted.Add(store, again))
+		result, err := deleted.Recent(store, me)
+		is.NoErr(err)
+		is.Equal(len(result), 2)
+		is.Equal(result[0].URL, older.URL)
+	})
+
+	t.Run("undeleted post is removed", func(t *testing.T) {
+		is.NoErr(store.Delete(me, newer.URL))
+		result, err := deleted.Recent(store, me)
+		is.NoErr(err)
+		is.Equal(len(result), 1)
+		is.Equal(result[0].URL, older.URL)
+	})
+
+	t.Run("only the newest posts are kept", func(t *testing.T) {
+		for i := 0; i < deleted.MaxPosts+5; i++ {
+			is.NoErr(deleted.Add(store, deleted.Post{
+				Me:        me,
+				URL:       "https://example.com/many/" + strconv.Itoa(i),
+				DeletedAt: now.Add(time.Duration(i) * time.Hour),
+			}))
+		}
+		all, err := store.List(me)
+		is.NoErr(err)
+		is.Equal(len(all), deleted.MaxPosts)
+		result, err := deleted.Recent(store, me)
+		is.NoErr(err)
+		is.Equal(result[0].URL, "https://example.com/many/"+strconv.Itoa(deleted.MaxPosts+4))
+	})
+
+	t.Run("other sites keep their posts", func(t *testing.T) {
+		result, err := deleted.Recent(store, other.Me)
+		is.NoErr(err)
+		is.Equal(len(result), 1)
+		is.Equal(result[0].URL, other.URL)
+	})
+}
@@ -0,0 +1,164 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tomnomnom/linkheader"
+	"golang.org/x/net/html"
+)
+
+// rels looked for on profile pages
+const (
+	RelIndieAuthMetadata     = "indieauth-metadata"
+	RelAuthorizationEndpoint = "authorization_endpoint"
+	RelTokenEndpoint         = "token_endpoint"
+	RelMicropub              = "micropub"
+	RelMicrosub              = "microsub"
+)
+
+// maxBodySize stops a profile page from filling memory
+const maxBodySize = 2 << 20
+
+// Profile is a fetched profile page and the urls it links to
+type Profile struct {
+	// Me is the profile url, it is updated when every redirect on the way
+	// to the page was permanent
+	Me string
+	// URL is the url the page was served from
+	URL    string
+	Header http.Header
+	Body   []byte
+	// Rels holds the urls of each rel, in order of precedence
+	Rels map[string][]string
+}
+
+// Endpoint returns the url with the highest precedence for rel
+func (p Profile) Endpoint(rel string) string {
+	urls := p.Rels[rel]
+	if len(urls) == 0 {
+		return ""
+	}
+	return urls[0]
+}
+
+// Fetch GETs the profile url me and finds the urls it links to
+func Fetch(client *http.Client, me string) (Profile, error) {
+	var profile Profile
+
+	// follow redirects with a copy so the callers client is not changed
+	permanent := true
+	redirects := *client
+	redirects.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		if req.Response != nil &&
+			req.Response.StatusCode != http.StatusMovedPermanently &&
+			req.Response.StatusCode != http.StatusPermanentRedirect {
+			permanent = false
+		}
+		return nil
+	}
+
+	resp, err := redirects.Get(me)
+	if err != nil {
+		return profile, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return profile, fmt.Errorf("%s returned a non-200: %d", me, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return profile, fmt.Errorf("failed to read %s: %v", me, err)
+	}
+
+	profile.URL = resp.Request.URL.String()
+	profile.Me = me
+	if permanent {
+		profile.Me = profile.URL
+	}
+	profile.Header = resp.Header
+	profile.Body = body
+	profile.Rels = Rels(profile.URL, resp.Header, body)
+	return profile, nil
+}
+
+// Rels finds the urls of each rel in the Link headers and html of a page.
+// Link headers take precedence over html, which is read in document order,
+// and every url is resolved against pageURL
+func Rels(pageURL string, header http.Header, body []byte) map[string][]string {
+	rels := make(map[string][]string)
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return rels
+	}
+
+	for _, value := range header["Link"] {
+		for _, link := range linkheader.Parse(value) {
+			addRels(rels, base, link.Rel, link.URL)
+		}
+	}
+
+	// pages are parsed whatever their content type as profile pages are
+	// often served with the wrong one
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return rels
+	}
+	findRels(doc, rels, base, false)
+	return rels
+}
+
+// findRels walks the html tree adding the rels of link and a elements, the
+// first base element changes the url relative links are resolved against
+func findRels(n *html.Node, rels map[string][]string, base *url.URL, hasBase bool) (*url.URL, bool) {
+	if n.Type == html.ElementNode {
+		switch n.Data {
+		case "base":
+			href, ok := attr(n, "href")
+			if ok && !hasBase {
+				if u, err := base.Parse(href); err == nil {
+					base = u
+				}
+				hasBase = true
+			}
+		case "link", "a":
+			rel, _ := attr(n, "rel")
+			href, ok := attr(n, "href")
+			if ok {
+				addRels(rels, base, rel, href)
+			}
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		base, hasBase = findRels(c, rels, base, hasBase)
+	}
+	return base, hasBase
+}
+
+// addRels adds href to each of the space separated rels
+func addRels(rels map[string][]string, base *url.URL, rel, href string) {
+	u, err := base.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return
+	}
+	for _, r := range strings.Fields(strings.ToLower(rel)) {
+		rels[r] = append(rels[r], u.String())
+	}
+}
+
+func attr(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
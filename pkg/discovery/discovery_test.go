@@ -0,0 +1,205 @@
+package discovery_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/discovery"
+	"github.com/matryer/is"
+)
+
+// newFixtureServer serves testdata/<fixture> from /profile/ with link as
+// its Link header
+func newFixtureServer(t *testing.T, fixture, link, contentType string) *httptest.Server {
+	body, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %s", err.Error())
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/profile/":
+			if link != "" {
+				w.Header().Add("Link", link)
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Write(body)
+		case "/moved":
+			http.Redirect(w, r, "/profile/", http.StatusMovedPermanently)
+		case "/found":
+			http.Redirect(w, r, "/profile/", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestFetch(t *testing.T) {
+
+	var tests = []struct {
+		name        string
+		fixture     string
+		link        string
+		contentType string
+		rel         string
+		expected    string
+	}{
+		{
+			name:     "html link",
+			fixture:  "links.html",
+			rel:      discovery.RelAuthorizationEndpoint,
+			expected: "https://auth.example.com/auth",
+		},
+		{
+			name:     "html link with a Link header for another rel",
+			fixture:  "links.html",
+			link:     `<https://micropub.example.com/>; rel="micropub"`,
+			rel:      discovery.RelAuthorizationEndpoint,
+			expected: "https://auth.example.com/auth",
+		},
+		{
+			name:     "Link header takes precedence over html",
+			fixture:  "links.html",
+			link:     `<https://micropub.example.com/>; rel="micropub"`,
+			rel:      discovery.RelMicropub,
+			expected: "https://micropub.example.com/",
+		},
+		{
+			name:     "relative Link header",
+			fixture:  "empty.html",
+			link:     `</token>; rel="token_endpoint", <../metadata>; rel="indieauth-metadata"`,
+			rel:      discovery.RelIndieAuthMetadata,
+			expected: "{server}/metadata",
+		},
+		{
+			name:     "Link header with several rels",
+			fixture:  "empty.html",
+			link:     `</endpoint>; rel="micropub microsub"`,
+			rel:      discovery.RelMicrosub,
+			expected: "{server}/endpoint",
+		},
+		{
+			name:     "root relative html link",
+			fixture:  "links.html",
+			rel:      discovery.RelTokenEndpoint,
+			expected: "{server}/token",
+		},
+		{
+			name:     "path relative html link with several rels",
+			fixture:  "links.html",
+			rel:      discovery.RelMicrosub,
+			expected: "{server}/profile/endpoints/1",
+		},
+		{
+			name:     "html link relative to base",
+			fixture:  "base.html",
+			rel:      discovery.RelMicropub,
+			expected: "{server}/blog/micropub",
+		},
+		{
+			name:     "rel on an a element",
+			fixture:  "links.html",
+			rel:      "me",
+			expected: "https://github.com/jay",
+		},
+		{
+			name:        "html served with the wrong content type",
+			fixture:     "links.html",
+			contentType: "text/plain",
+			rel:         discovery.RelAuthorizationEndpoint,
+			expected:    "https://auth.example.com/auth",
+		},
+		{
+			name:     "missing rel",
+			fixture:  "empty.html",
+			rel:      discovery.RelMicropub,
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = "text/html; charset=utf-8"
+			}
+			server := newFixtureServer(t, tt.fixture, tt.link, contentType)
+			defer server.Close()
+
+			// act
+			profile, err := discovery.Fetch(&http.Client{}, server.URL+"/profile/")
+
+			// assert
+			is.NoErr(err)
+			is.Equal(profile.Endpoint(tt.rel), strings.Replace(tt.expected, "{server}", server.URL, 1))
+		})
+	}
+}
+
+func TestFetchRelOrder(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	server := newFixtureServer(t, "links.html", `</header-token>; rel="token_endpoint"`, "text/html")
+	defer server.Close()
+
+	// act
+	profile, err := discovery.Fetch(&http.Client{}, server.URL+"/profile/")
+
+	// assert
+	is.NoErr(err)
+	is.Equal(profile.Rels[discovery.RelTokenEndpoint], []string{
+		server.URL + "/header-token",
+		server.URL + "/token",
+		server.URL + "/second-token",
+	})
+}
+
+func TestFetchRedirects(t *testing.T) {
+
+	var tests = []struct {
+		name         string
+		path         string
+		expectedMe   string
+		expectsError bool
+	}{
+		{name: "no redirect", path: "/profile/", expectedMe: "/profile/"},
+		{name: "permanent redirect updates me", path: "/moved", expectedMe: "/profile/"},
+		{name: "temporary redirect keeps me", path: "/found", expectedMe: "/found"},
+		{name: "missing page", path: "/missing", expectsError: true},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			server := newFixtureServer(t, "links.html", "", "text/html")
+			defer server.Close()
+
+			// act
+			profile, err := discovery.Fetch(&http.Client{}, server.URL+tt.path)
+
+			// assert
+			if tt.expectsError {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(profile.Me, server.URL+tt.expectedMe)
+			is.Equal(profile.URL, server.URL+"/profile/")
+			is.Equal(profile.Endpoint(discovery.RelTokenEndpoint), server.URL+"/token")
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package gazetteer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
+)
+
+// file names of the GeoNames dumps read by Open
+const (
+	CitiesFile    = "cities500.txt"
+	Admin1File    = "admin1CodesASCII.txt"
+	Admin2File    = "admin2Codes.txt"
+	CountriesFile = "countryInfo.txt"
+)
+
+// maxResults is how many places a name lookup returns
+const maxResults = 10
+
+// columns of the GeoNames geoname table
+const (
+	colName        = 1
+	colASCIIName   = 2
+	colLat         = 4
+	colLng         = 5
+	colCountryCode = 8
+	colAdmin1      = 10
+	colAdmin2      = 11
+	colPopulation  = 14
+	geonameColumns = 19
+)
+
+type place struct {
+	name       string
+	lat        float64
+	lng        float64
+	region     string
+	country    string
+	population int
+}
+
+func (p place) toLocation() session.Location {
+	return session.Location{
+		Lat:      p.lat,
+		Lng:      p.lng,
+		Locality: p.name,
+		Region:   p.region,
+		Country:  p.country,
+	}
+}
+
+// nameKey is a lower case name pointing at a place, places are indexed by
+// their name and ascii name
+type nameKey struct {
+	name  string
+	place int
+}
+
+// point is a place on the unit sphere, so the nearest place by straight
+// line distance is also the nearest by great circle distance
+type point struct {
+	xyz   [3]float64
+	place int
+}
+
+// Gazetteer looks up places in a GeoNames dump held in memory, so places
+// can be found without a network
+type Gazetteer struct {
+	places []place
+	names  []nameKey
+	tree   []point
+}
+
+// Open loads the GeoNames dumps in dir, only the cities file is required,
+// without the others regions and countries are left as codes
+func Open(dir string) (*Gazetteer, error) {
+	cities, err := os.Open(filepath.Join(dir, CitiesFile))
+	if err != nil {
+		return nil, err
+	}
+	defer cities.Close()
+
+	var names []io.Reader
+	for _, file := range []string{Admin1File, Admin2File, CountriesFile} {
+		f, err := os.Open(filepath.Join(dir, file))
+		if os.IsNotExist(err) {
+			names = append(names, nil)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		names = append(names, f)
+	}
+	return New(cities, names[0], names[1], names[2])
+}
+
+// New builds a gazetteer from a cities dump, admin1, admin2 and countries
+// are the GeoNames name tables and may be nil
+func New(cities, admin1, admin2, countries io.Reader) (*Gazetteer, error) {
+	admin1Names, err := readNames(admin1, 0, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin1 codes: %v", err)
+	}
+	admin2Names, err := readNames(admin2, 0, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin2 codes: %v", err)
+	}
+	countryNames, err := readNames(countries, 0, 4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read countries: %v", err)
+	}
+
+	g := &Gazetteer{}
+	err = eachRow(cities, func(line int, cols []string) error {
+		if len(cols) < geonameColumns {
+			return fmt.Errorf("line %d has %d columns", line, len(cols))
+		}
+		lat, err := strconv.ParseFloat(cols[colLat], 64)
+		if err != nil {
+			return fmt.Errorf("line %d has an invalid latitude", line)
+		}
+		lng, err := strconv.ParseFloat(cols[colLng], 64)
+		if err != nil {
+			return fmt.Errorf("line %d has an invalid longitude", line)
+		}
+		population, _ := strconv.Atoi(cols[colPopulation])
+
+		countryCode := cols[colCountryCode]
+		admin1Code := countryCode + "." + cols[colAdmin1]
+		admin2Code := admin1Code + "." + cols[colAdmin2]
+		region := firstOf(admin2Names[admin2Code], admin1Names[admin1Code], cols[colAdmin1])
+
+		i := len(g.places)
+		g.places = append(g.places, place{
+			name:       cols[colName],
+			lat:        lat,
+			lng:        lng,
+			region:     region,
+			country:    firstOf(countryNames[countryCode], countryCode),
+			population: population,
+		})
+		g.names = append(g.names, nameKey{name: normalize(cols[colName]), place: i})
+		if ascii := normalize(cols[colASCIIName]); ascii != "" && ascii != normalize(cols[colName]) {
+			g.names = append(g.names, nameKey{name: ascii, place: i})
+		}
+		g.tree = append(g.tree, point{xyz: toXYZ(lat, lng), place: i})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cities: %v", err)
+	}
+
+	sort.Slice(g.names, func(i, j int) bool {
+		return g.names[i].name < g.names[j].name
+	})
+	buildTree(g.tree, 0)
+	return g, nil
+}
+
+// Lookup finds places with a name starting with the first part of
+// address, exact matches come first followed by the biggest places
+func (g *Gazetteer) Lookup(address string) []session.Location {
+	locList := []session.Location{}
+	prefix := normalize(strings.Split(address, ",")[0])
+	if prefix == "" {
+		return locList
+	}
+
+	seen := make(map[int]bool)
+	var found []int
+	start := sort.Search(len(g.names), func(i int) bool {
+		return g.names[i].name >= prefix
+	})
+	for _, key := range g.names[start:] {
+		if !strings.HasPrefix(key.name, prefix) {
+			break
+		}
+		if !seen[key.place] {
+			seen[key.place] = true
+			found = append(found, key.place)
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		a, b := g.places[found[i]], g.places[found[j]]
+		exactA, exactB := normalize(a.name) == prefix, normalize(b.name) == prefix
+		if exactA != exactB {
+			return exactA
+		}
+		return a.population > b.population
+	})
+	if len(found) > maxResults {
+		found = found[:maxResults]
+	}
+	for _, i := range found {
+		locList = append(locList, g.places[i].toLocation())
+	}
+	return locList
+}
+
+// LookupLatLng finds the place nearest to lat, lng
+func (g *Gazetteer) LookupLatLng(lat, lng float64) []session.Location {
+	if len(g.tree) == 0 {
+		return []session.Location{}
+	}
+	best, bestDist := -1, math.Inf(1)
+	nearest(g.tree, 0, toXYZ(lat, lng), &best, &bestDist)
+	return []session.Location{g.places[best].toLocation()}
+}
+
+// buildTree sorts points in place into an implicit k-d tree, the median
+// of each range is the node splitting the rest of the range
+func buildTree(points []point, depth int) {
+	if len(points) < 2 {
+		return
+	}
+	axis := depth % 3
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].xyz[axis] < points[j].xyz[axis]
+	})
+	m := len(points) / 2
+	buildTree(points[:m], depth+1)
+	buildTree(points[m+1:], depth+1)
+}
+
+func nearest(points []point, depth int, target [3]float64, best *int, bestDist *float64) {
+	if len(points) == 0 {
+		return
+	}
+	m := len(points) / 2
+	node := points[m]
+	d := distance2(node.xyz, target)
+	if d < *bestDist {
+		*best, *bestDist = node.place, d
+	}
+
+	// search the side of the target first, the other side can only hold
+	// a nearer place if the target is nearer to the split than the best
+	axis := depth % 3
+	diff := target[axis] - node.xyz[axis]
+	near, far := points[:m], points[m+1:]
+	if diff > 0 {
+		near, far = far, near
+	}
+	nearest(near, depth+1, target, best, bestDist)
+	if diff*diff < *bestDist {
+		nearest(far, depth+1, target, best, bestDist)
+	}
+}
+
+func toXYZ(lat, lng float64) [3]float64 {
+	phi := lat * math.Pi / 180
+	lambda := lng * math.Pi / 180
+	return [3]float64{
+		math.Cos(phi) * math.Cos(lambda),
+		math.Cos(phi) * math.Sin(lambda),
+		math.Sin(phi),
+	}
+}
+
+func distance2(a, b [3]float64) float64 {
+	var d float64
+	for i := range a {
+		d += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return d
+}
+
+// readNames maps the code in column key to the name in column value of a
+// GeoNames name table
+func readNames(r io.Reader, key, value int) (map[string]string, error) {
+	names := make(map[string]string)
+	if r == nil {
+		return names, nil
+	}
+	err := eachRow(r, func(line int, cols []string) error {
+		if len(cols) <= value {
+			return fmt.Errorf("line %d has %d columns", line, len(cols))
+		}
+		names[cols[key]] = cols[value]
+		return nil
+	})
+	return names, err
+}
+
+// eachRow calls fn with the tab separated columns of each line, skipping
+// blank lines and # comments
+func eachRow(r io.Reader, fn func(line int, cols []string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		err := fn(line, strings.Split(text, "\t"))
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,190 @@
+package gazetteer_test
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/gazetteer"
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
+	"github.com/matryer/is"
+)
+
+func openTestGazetteer(t *testing.T) *gazetteer.Gazetteer {
+	g, err := gazetteer.Open("testdata")
+	if err != nil {
+		t.Fatalf("failed to open gazetteer: %s", err.Error())
+	}
+	return g
+}
+
+func TestLookup(t *testing.T) {
+
+	leeds := session.Location{Lat: 53.79648, Lng: -1.54785, Locality: "Leeds", Region: "Leeds", Country: "United Kingdom"}
+	leek := session.Location{Lat: 53.10634, Lng: -2.02422, Locality: "Leek", Region: "England", Country: "United Kingdom"}
+
+	var tests = []struct {
+		name     string
+		address  string
+		expected []session.Location
+	}{
+		{name: "prefix ordered by population", address: "lee", expected: []session.Location{leeds, leek}},
+		{name: "exact name first", address: "Leek", expected: []session.Location{leek}},
+		{name: "address with a country", address: "Leeds, UK", expected: []session.Location{leeds}},
+		{
+			name:    "ascii name",
+			address: "munc",
+			expected: []session.Location{
+				{Lat: 48.13743, Lng: 11.57549, Locality: "München", Region: "Upper Bavaria", Country: "Germany"},
+			},
+		},
+		{
+			name:    "region without admin2 names",
+			address: "opatje",
+			expected: []session.Location{
+				{Lat: 45.85556, Lng: 13.59611, Locality: "Opatje selo", Region: "Občina Miren-Kostanjevica", Country: "Slovenia"},
+			},
+		},
+		{name: "unknown place", address: "oprtalj", expected: []session.Location{}},
+		{name: "empty", address: " ", expected: []session.Location{}},
+	}
+
+	g := openTestGazetteer(t)
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			result := g.Lookup(tt.address)
+
+			// assert
+			is.Equal(result, tt.expected)
+		})
+	}
+}
+
+func TestLookupLatLng(t *testing.T) {
+
+	var tests = []struct {
+		name             string
+		lat              float64
+		lng              float64
+		expectedLocality string
+	}{
+		{name: "meanwood", lat: 53.8324973, lng: -1.5698563, expectedLocality: "Leeds"},
+		{name: "city centre", lat: 53.80097961111111, lng: -1.5413867222222222, expectedLocality: "Leeds"},
+		{name: "across the antimeridian", lat: -17.5, lng: -179.9, expectedLocality: "Suva"},
+		{name: "bavaria", lat: 47.9, lng: 11.3, expectedLocality: "München"},
+	}
+
+	g := openTestGazetteer(t)
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			result := g.LookupLatLng(tt.lat, tt.lng)
+
+			// assert
+			is.Equal(len(result), 1)
+			is.Equal(result[0].Locality, tt.expectedLocality)
+		})
+	}
+}
+
+func TestLookupLatLngMatchesBruteForce(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	rnd := rand.New(rand.NewSource(1))
+	randomLatLng := func() (float64, float64) {
+		return math.Asin(2*rnd.Float64()-1) * 180 / math.Pi, rnd.Float64()*360 - 180
+	}
+	cities := new(bytes.Buffer)
+	var lats, lngs []float64
+	for i := 0; i < 2000; i++ {
+		lat, lng := randomLatLng()
+		lats, lngs = append(lats, lat), append(lngs, lng)
+		fmt.Fprintf(cities, "%d\tplace-%d\tplace-%d\t\t%g\t%g\tP\tPPL\tXX\t\t01\t\t\t\t500\t\t0\tUTC\t2019-01-01\n", i, i, i, lat, lng)
+	}
+	g, err := gazetteer.New(cities, nil, nil, nil)
+	is.NoErr(err)
+
+	for q := 0; q < 500; q++ {
+		lat, lng := randomLatLng()
+
+		// act
+		result := g.LookupLatLng(lat, lng)
+
+		// assert
+		best, bestDist := 0, math.Inf(1)
+		for i := range lats {
+			d := greatCircle(lat, lng, lats[i], lngs[i])
+			if d < bestDist {
+				best, bestDist = i, d
+			}
+		}
+		is.Equal(result[0].Locality, fmt.Sprintf("place-%d", best))
+		is.Equal(result[0].Region, "01")
+		is.Equal(result[0].Country, "XX")
+	}
+}
+
+func greatCircle(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLng := (lat2-lat1)*rad, (lng2-lng1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * math.Asin(math.Sqrt(a))
+}
+
+func TestOpen(t *testing.T) {
+
+	var tests = []struct {
+		name         string
+		dir          string
+		expectsError bool
+	}{
+		{name: "dump", dir: "testdata"},
+		{name: "missing dump", dir: filepath.Join("testdata", "missing"), expectsError: true},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			_, err := gazetteer.Open(tt.dir)
+
+			// assert
+			is.Equal(err != nil, tt.expectsError)
+			if tt.expectsError {
+				is.True(os.IsNotExist(err))
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidRows(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// act
+	_, err := gazetteer.New(bytes.NewBufferString("1\tLeeds\tLeeds\n"), nil, nil, nil)
+
+	// assert
+	is.True(err != nil)
+}
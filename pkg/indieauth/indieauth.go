@@ -8,33 +8,40 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/j4y_funabashi/inari-admin/pkg/cookie"
 	"github.com/j4y_funabashi/inari-admin/pkg/session"
 	"github.com/sirupsen/logrus"
 )
 
-type TokenEndpoint interface {
-	VerifyAccessToken(bearerToken string) TokenResponse
-}
+// TokenCheckInterval is how often an access token is checked with the
+// authorization server
+const TokenCheckInterval = 15 * time.Minute
 
-type tokenEndpoint struct {
-	URL string
-}
+// TokenRefreshMargin is how long before they expire tokens are refreshed
+const TokenRefreshMargin = time.Minute
 
 type TokenResponse struct {
 	Me               string `json:"me"`
 	ClientId         string `json:"client_id"`
 	Scope            string `json:"scope"`
 	IssuedBy         string `json:"issued_by"`
+	Active           bool   `json:"active"`
 	Error            string `json:"error"`
 	ErrorDescription string `json:"error_description"`
 	StatusCode       int
+	// Introspected is true for responses from an introspection endpoint
+	Introspected bool `json:"-"`
 }
 
 func (tr TokenResponse) IsValid() bool {
 	if tr.StatusCode != 200 {
 		return false
 	}
+	if tr.Introspected {
+		return tr.Active
+	}
 	if strings.TrimSpace(tr.Me) == "" {
 		return false
 	}
@@ -44,6 +51,19 @@ func (tr TokenResponse) IsValid() bool {
 	return true
 }
 
+// IsRevoked is true when the authorization server says the token can no
+// longer be used, server errors are not treated as revoked
+func (tr TokenResponse) IsRevoked() bool {
+	if tr.Introspected {
+		return tr.StatusCode == http.StatusOK && !tr.Active
+	}
+	switch tr.StatusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	}
+	return false
+}
+
 type Response struct {
 	Headers    map[string]string
 	Body       string
@@ -51,58 +71,173 @@ type Response struct {
 }
 
 type Client interface {
-	VerifyAccessToken(bearerToken string) (TokenResponse, error)
-	Init(me, clientId, redirectUri string) Response
-	Callback(state, code, clientId, redirectUri string) Response
+	VerifyAccessToken(usess session.UserSession) (TokenResponse, error)
+	RefreshIfNeeded(usess session.UserSession, now time.Time) (session.UserSession, error)
+	Init(me, clientId, redirectUri, scope, returnTo string) Response
+	Callback(state, code, iss, clientId, redirectUri string, sessionIDs []string) Response
+	Logout(sessionIDs []string) Response
+	SwitchAccount(sessionIDs []string, me string) Response
+	RevokeToken(tokenEndpoint, accessToken string) error
+	SweepSessions(now time.Time)
+	RunSessionSweeper(interval time.Duration)
 }
 
-func NewClient(tokenEndpoint string, sessionStore session.SessionStore, logger *logrus.Logger) Client {
+func NewClient(sessionStore session.SessionStore, cookies cookie.Jar, logger *logrus.Logger) Client {
 	return client{
-		TokenEndpoint: tokenEndpoint,
-		SessionStore:  sessionStore,
-		logger:        logger,
+		SessionStore: sessionStore,
+		cookies:      cookies,
+		logger:       logger,
 	}
 }
 
 type client struct {
-	TokenEndpoint string
-	SessionStore  session.SessionStore
-	logger        *logrus.Logger
+	SessionStore session.SessionStore
+	cookies      cookie.Jar
+	logger       *logrus.Logger
 }
 
-func (client client) VerifyAccessToken(bearerToken string) (TokenResponse, error) {
-	req, err := http.NewRequest("GET", client.TokenEndpoint, nil)
+// VerifyAccessToken asks the authorization server of usess if its access
+// token is still valid, using the introspection endpoint when there is one
+func (client client) VerifyAccessToken(usess session.UserSession) (TokenResponse, error) {
+	var req *http.Request
+	var err error
+	if usess.IntrospectionEndpoint != "" {
+		data := url.Values{}
+		data.Set("token", usess.AccessToken)
+		req, err = http.NewRequest("POST", usess.IntrospectionEndpoint, strings.NewReader(data.Encode()))
+		if err == nil {
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest("GET", usess.TokenEndpoint, nil)
+	}
 	if err != nil {
-		log.Printf("failed to create GET request: %s", err.Error())
-		return TokenResponse{}, err
+		return TokenResponse{}, fmt.Errorf("failed to build token verification request: %v", err)
 	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Authorization", bearerToken)
+	req.Header.Add("Authorization", "Bearer "+usess.AccessToken)
 	req.Header.Add("Accept", "application/json")
 
 	c := &http.Client{}
 	resp, err := c.Do(req)
 	if err != nil {
-		log.Printf("failed to GET token endpoint: %s", err.Error())
-		return TokenResponse{}, err
+		return TokenResponse{}, fmt.Errorf("failed to verify access token: %v", err)
 	}
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("failed to read response body: %s", err.Error())
-		return TokenResponse{}, err
+		return TokenResponse{}, fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	tokenRes := TokenResponse{
+		StatusCode:   resp.StatusCode,
+		Introspected: usess.IntrospectionEndpoint != "",
+	}
+	if resp.StatusCode == http.StatusOK {
+		err = json.Unmarshal(body, &tokenRes)
+		if err != nil {
+			return TokenResponse{}, fmt.Errorf("failed to unmarshal response body: %v", err)
+		}
+	}
+	return tokenRes, nil
+}
+
+// RefreshIfNeeded keeps the access token of usess usable, tokens about to
+// expire are refreshed and other tokens are checked every
+// TokenCheckInterval. ErrTokenRevoked is returned when the user has to log
+// in again
+func (client client) RefreshIfNeeded(usess session.UserSession, now time.Time) (session.UserSession, error) {
+	if usess.TokenExpiresSoon(now, TokenRefreshMargin) {
+		return client.refreshToken(usess, now)
+	}
+	if now.Sub(usess.TokenCheckedAt) < TokenCheckInterval {
+		return usess, nil
+	}
+
+	tokenRes, err := client.VerifyAccessToken(usess)
+	if err != nil {
+		// the authorization server may be down, check again next time
+		client.logger.WithError(err).Info("failed to verify access token")
+		return usess, nil
+	}
+	if tokenRes.IsRevoked() {
+		client.logger.WithField("me", usess.Me).Info("access token was revoked")
+		return client.refreshToken(usess, now)
+	}
+	if !tokenRes.IsValid() {
+		client.logger.WithField("status", tokenRes.StatusCode).Info("could not verify access token")
+	}
+
+	// server errors are not retried until the next check so an
+	// authorization server that is down is not asked on every request
+	usess.TokenCheckedAt = now
+	err = client.SessionStore.Create(usess)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to save session")
+	}
+	return usess, nil
+}
+
+// refreshToken swaps the refresh token of usess for a new access token
+func (client client) refreshToken(usess session.UserSession, now time.Time) (session.UserSession, error) {
+	if usess.RefreshToken == "" {
+		return usess, session.ErrTokenRevoked
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", usess.RefreshToken)
+	data.Set("client_id", usess.ClientId)
+	req, err := http.NewRequest("POST", usess.TokenEndpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		return usess, fmt.Errorf("failed to build refresh request: %v", err)
 	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	tokenRes := TokenResponse{StatusCode: resp.StatusCode}
+	httpclient := &http.Client{}
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		return usess, fmt.Errorf("failed to refresh access token: %v", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized:
+		// the refresh token was revoked or has expired
+		return usess, session.ErrTokenRevoked
+	case resp.StatusCode != http.StatusOK:
+		return usess, fmt.Errorf("token endpoint returned a non-200: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return usess, fmt.Errorf("failed to read refresh response: %v", err)
+	}
+	var tokenRes VerifyCodeResponse
 	err = json.Unmarshal(body, &tokenRes)
+	if err != nil || tokenRes.AccessToken == "" {
+		return usess, fmt.Errorf("token endpoint did not return an access token")
+	}
+
+	usess.SetToken(tokenRes.AccessToken, tokenRes.RefreshToken, tokenRes.Scope, tokenRes.ExpiresIn, now)
+	err = client.SessionStore.Create(usess)
 	if err != nil {
-		log.Printf("failed to unmarshal response body: %s", err.Error())
-		return TokenResponse{}, err
+		return usess, fmt.Errorf("failed to save session: %v", err)
 	}
-	return tokenRes, nil
+	client.logger.WithField("me", usess.Me).Info("refreshed access token")
+	return usess, nil
 }
 
-func (client client) Init(me, clientID, redirectURI string) Response {
+// Init starts logging in me asking for scope, once logged in the user is
+// sent to returnTo
+func (client client) Init(me, clientID, redirectURI, scope, returnTo string) Response {
 	var res Response
+	me, err := session.CanonicalizeMe(me)
+	if err != nil {
+		client.logger.WithError(err).Info("invalid profile url")
+		res.StatusCode = http.StatusBadRequest
+		res.Body = err.Error()
+		return res
+	}
 	usess, err := session.NewUserSession(
 		me,
 		clientID,
@@ -114,6 +249,10 @@ func (client client) Init(me, clientID, redirectURI string) Response {
 		res.Body = err.Error()
 		return res
 	}
+	if scope != "" {
+		usess.Scope = scope
+	}
+	usess.ReturnTo = returnTo
 	err = usess.DiscoverEndpoints()
 	if err != nil {
 		client.logger.WithError(err).Error("failed to discover endpoints")
@@ -144,33 +283,17 @@ func (client client) Init(me, clientID, redirectURI string) Response {
 }
 
 type VerifyCodeResponse struct {
-	Me          string `json:"me"`
-	Scope       string `json:"scope"`
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-}
-
-func (vr VerifyCodeResponse) CompareDomains(other string) error {
-	d1 := vr.parseDomain(vr.Me)
-	d2 := vr.parseDomain(other)
-	log.Printf("d1:: %s -> %s", vr.Me, d1)
-	log.Printf("d2:: %s -> %s", other, d2)
-	if strings.ToLower(d1) != strings.ToLower(d2) {
-		return fmt.Errorf("domains do not match %s != %s", d1, d2)
-	}
-	return nil
-}
-func (vr VerifyCodeResponse) parseDomain(dom string) string {
-	me, err := url.Parse(dom)
-	if err != nil {
-		return ""
-	}
-	parts := strings.Split(me.Hostname(), ".")
-	domain := parts[len(parts)-2] + "." + parts[len(parts)-1]
-	return domain
+	Me           string `json:"me"`
+	Scope        string `json:"scope"`
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
 }
 
-func (client client) Callback(state, code, clientId, redirectUri string) Response {
+// Callback finishes a login, sessionIDs are the sites the browser is
+// already logged in to and stay logged in
+func (client client) Callback(state, code, iss, clientId, redirectUri string, sessionIDs []string) Response {
 	var res Response
 
 	// FETCH USER SESSION
@@ -186,7 +309,15 @@ func (client client) Callback(state, code, clientId, redirectUri string) Respons
 		res.StatusCode = http.StatusForbidden
 		return res
 	}
-	log.Printf("user session: %+v", s)
+	// servers that publish metadata must say they issued the code
+	if s.Issuer != "" && s.Issuer != iss {
+		client.logger.
+			WithField("expected", s.Issuer).
+			WithField("iss", iss).
+			Info("authorization response came from the wrong issuer")
+		res.StatusCode = http.StatusForbidden
+		return res
+	}
 
 	// AUTHORIZATION CODE VERIFICATION
 
@@ -198,6 +329,7 @@ func (client client) Callback(state, code, clientId, redirectUri string) Respons
 	data.Set("client_id", clientId)
 	data.Set("redirect_uri", redirectUri)
 	data.Set("me", s.Me)
+	data.Set("code_verifier", s.CodeVerifier)
 	req, err := http.NewRequest("POST", s.TokenEndpoint, strings.NewReader(data.Encode()))
 	if err != nil {
 		log.Printf("failed to build verify code request: %+v", err)
@@ -221,7 +353,6 @@ func (client client) Callback(state, code, clientId, redirectUri string) Respons
 	}
 
 	// parse verification response
-	log.Printf("verify code response: %+v", resp)
 	body, err := ioutil.ReadAll(resp.Body)
 	defer resp.Body.Close()
 	if err != nil {
@@ -231,18 +362,42 @@ func (client client) Callback(state, code, clientId, redirectUri string) Respons
 	}
 	var verifyRes VerifyCodeResponse
 	json.Unmarshal(body, &verifyRes)
-	log.Printf("verify code response: %+v", verifyRes)
+	client.logger.
+		WithField("me", verifyRes.Me).
+		WithField("scope", verifyRes.Scope).
+		WithField("status", resp.StatusCode).
+		Info("verified authorization code")
 
-	err = verifyRes.CompareDomains(s.Me)
+	profile, err := s.VerifyMe(verifyRes.Me)
 	if err != nil {
-		log.Printf("%s", err)
+		client.logger.WithError(err).WithField("me", verifyRes.Me).Info("failed to verify me")
 		res.StatusCode = http.StatusForbidden
 		return res
 	}
+	// the returned me can be another page with its own endpoints
+	s.SetProfile(profile)
+
+	// send the user back to the page they asked for before logging in
+	returnTo := s.ReturnTo
+	if returnTo == "" {
+		returnTo = "/composer"
+	}
+	s.ReturnTo = ""
 
-	s.AccessToken = verifyRes.AccessToken
+	// the token may be granted fewer scopes than were asked for
+	s.SetToken(verifyRes.AccessToken, verifyRes.RefreshToken, verifyRes.Scope, verifyRes.ExpiresIn, time.Now())
 	s.TokenType = verifyRes.TokenType
-	s.DiscoverMediaEndpoint()
+	s.Extend(time.Now())
+	s.DiscoverMicropubConfig()
+
+	// the logged in session gets a new id so the state can not be used
+	// as a session id
+	err = s.Rotate()
+	if err != nil {
+		log.Printf("failed to rotate session id: %+v", err)
+		res.StatusCode = http.StatusInternalServerError
+		return res
+	}
 
 	// save session
 	err = client.SessionStore.Create(s)
@@ -251,15 +406,157 @@ func (client client) Callback(state, code, clientId, redirectUri string) Respons
 		res.StatusCode = http.StatusInternalServerError
 		return res
 	}
+	err = client.SessionStore.Delete(state)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to delete login session")
+	}
+
+	// the new login becomes the active site, logging in to a site again
+	// replaces its old session
+	accounts := []session.UserSession{s}
+	for _, other := range session.FetchAccounts(client.SessionStore, sessionIDs) {
+		if other.Me != s.Me {
+			accounts = append(accounts, other)
+			continue
+		}
+		err = client.SessionStore.Delete(other.Uid)
+		if err != nil {
+			client.logger.WithError(err).Error("failed to delete replaced session")
+		}
+	}
+	ids, expiresAt := session.AccountIDs(accounts)
 
 	// drop cookie and redirect
-	cookie := fmt.Sprintf("sessionid=%s; Path=/", s.Uid)
 	headers := map[string]string{
-		"Location":   "/composer",
-		"Set-Cookie": cookie,
+		"Location":   returnTo,
+		"Set-Cookie": client.cookies.SessionsCookie(ids, expiresAt, time.Now()),
 	}
 	res.StatusCode = http.StatusSeeOther
 	res.Headers = headers
 
 	return res
 }
+
+// Logout revokes the access token and deletes the session of the active
+// site, the browser stays logged in to its other sites
+func (client client) Logout(sessionIDs []string) Response {
+	var res Response
+	sessionID := sessionIDs[0]
+
+	s, err := client.SessionStore.FetchByID(sessionID)
+	if err == nil && s.AccessToken != "" {
+		err = client.RevokeToken(s.TokenEndpoint, s.AccessToken)
+		if err != nil {
+			client.logger.WithError(err).Info("failed to revoke access token")
+		}
+	}
+
+	err = client.SessionStore.Delete(sessionID)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to delete session")
+		res.StatusCode = http.StatusInternalServerError
+		return res
+	}
+
+	location := "/login"
+	others := session.FetchAccounts(client.SessionStore, sessionIDs[1:])
+	if len(others) > 0 {
+		location = "/composer"
+	}
+	ids, expiresAt := session.AccountIDs(others)
+
+	headers := map[string]string{
+		"Location":   location,
+		"Set-Cookie": client.cookies.SessionsCookie(ids, expiresAt, time.Now()),
+	}
+	res.StatusCode = http.StatusSeeOther
+	res.Headers = headers
+
+	return res
+}
+
+// SwitchAccount makes me the site new posts are sent to, me must be one of
+// the sites of sessionIDs
+func (client client) SwitchAccount(sessionIDs []string, me string) Response {
+	var res Response
+
+	accounts := session.FetchAccounts(client.SessionStore, sessionIDs)
+	for i, usess := range accounts {
+		if usess.Me != me {
+			continue
+		}
+		switched := append([]session.UserSession{usess}, accounts[:i]...)
+		switched = append(switched, accounts[i+1:]...)
+		ids, expiresAt := session.AccountIDs(switched)
+
+		client.logger.WithField("me", me).Info("switched account")
+		res.StatusCode = http.StatusSeeOther
+		res.Headers = map[string]string{
+			"Location":   "/composer",
+			"Set-Cookie": client.cookies.SessionsCookie(ids, expiresAt, time.Now()),
+		}
+		return res
+	}
+
+	client.logger.WithField("me", me).Info("browser is not logged in to account")
+	res.StatusCode = http.StatusBadRequest
+	return res
+}
+
+// RevokeToken asks the token endpoint to revoke accessToken
+func (client client) RevokeToken(tokenEndpoint, accessToken string) error {
+	data := url.Values{}
+	data.Set("action", "revoke")
+	data.Set("token", accessToken)
+
+	req, err := http.NewRequest("POST", tokenEndpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	httpclient := &http.Client{}
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token endpoint returned a non-200: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SweepSessions deletes expired sessions and revokes their access tokens
+func (client client) SweepSessions(now time.Time) {
+	expired, err := client.SessionStore.FetchExpired(now)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to fetch expired sessions")
+		return
+	}
+
+	for _, s := range expired {
+		if s.AccessToken != "" {
+			err = client.RevokeToken(s.TokenEndpoint, s.AccessToken)
+			if err != nil {
+				client.logger.WithError(err).WithField("me", s.Me).Info("failed to revoke access token")
+			}
+		}
+		err = client.SessionStore.Delete(s.Uid)
+		if err != nil {
+			client.logger.WithError(err).Error("failed to delete expired session")
+			continue
+		}
+		client.logger.WithField("me", s.Me).Info("deleted expired session")
+	}
+}
+
+// RunSessionSweeper sweeps expired sessions every interval, forever
+func (client client) RunSessionSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		client.SweepSessions(now)
+	}
+}
@@ -0,0 +1,290 @@
+package indieauth_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/cookie"
+	"github.com/j4y_funabashi/inari-admin/pkg/indieauth"
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
+	"github.com/matryer/is"
+	"github.com/sirupsen/logrus"
+)
+
+func newTokenServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/introspect":
+			active := r.FormValue("token") != "revoked"
+			fmt.Fprintf(w, `{"active": %t, "me": "https://example.com/", "scope": "create"}`, active)
+		case r.Method == "POST" && r.FormValue("grant_type") == "refresh_token":
+			if r.FormValue("refresh_token") == "revoked" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": "invalid_grant"}`)
+				return
+			}
+			fmt.Fprint(w, `{"access_token": "new-token", "refresh_token": "new-refresh", "expires_in": 3600, "scope": "create update"}`)
+		case r.Header.Get("Authorization") == "Bearer valid":
+			fmt.Fprint(w, `{"me": "https://example.com/", "scope": "create"}`)
+		case r.Header.Get("Authorization") == "Bearer revoked":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func TestRefreshIfNeeded(t *testing.T) {
+
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name                 string
+		usess                session.UserSession
+		introspect           bool
+		expectedErr          error
+		expectedToken        string
+		expectedRefreshToken string
+		expectedCheckedAt    time.Time
+	}{
+		{
+			name:              "recently checked token",
+			usess:             session.UserSession{AccessToken: "unknown", TokenCheckedAt: now.Add(-time.Minute)},
+			expectedToken:     "unknown",
+			expectedCheckedAt: now.Add(-time.Minute),
+		},
+		{
+			name: "token about to expire is refreshed",
+			usess: session.UserSession{
+				AccessToken:    "old-token",
+				RefreshToken:   "refresh",
+				TokenExpiresAt: now.Add(30 * time.Second),
+				TokenCheckedAt: now,
+			},
+			expectedToken:        "new-token",
+			expectedRefreshToken: "new-refresh",
+			expectedCheckedAt:    now,
+		},
+		{
+			name: "expired token without a refresh token",
+			usess: session.UserSession{
+				AccessToken:    "old-token",
+				TokenExpiresAt: now.Add(-time.Hour),
+				TokenCheckedAt: now,
+			},
+			expectedErr: session.ErrTokenRevoked,
+		},
+		{
+			name: "revoked refresh token",
+			usess: session.UserSession{
+				AccessToken:    "old-token",
+				RefreshToken:   "revoked",
+				TokenExpiresAt: now.Add(-time.Hour),
+				TokenCheckedAt: now,
+			},
+			expectedErr: session.ErrTokenRevoked,
+		},
+		{
+			name:              "valid token checked with the token endpoint",
+			usess:             session.UserSession{AccessToken: "valid"},
+			expectedToken:     "valid",
+			expectedCheckedAt: now,
+		},
+		{
+			name:        "revoked token checked with the token endpoint",
+			usess:       session.UserSession{AccessToken: "revoked"},
+			expectedErr: session.ErrTokenRevoked,
+		},
+		{
+			name:                 "revoked token with a refresh token",
+			usess:                session.UserSession{AccessToken: "revoked", RefreshToken: "refresh"},
+			expectedToken:        "new-token",
+			expectedRefreshToken: "new-refresh",
+			expectedCheckedAt:    now,
+		},
+		{
+			name:              "active token checked with introspection",
+			usess:             session.UserSession{AccessToken: "valid"},
+			introspect:        true,
+			expectedToken:     "valid",
+			expectedCheckedAt: now,
+		},
+		{
+			name:        "inactive token checked with introspection",
+			usess:       session.UserSession{AccessToken: "revoked"},
+			introspect:  true,
+			expectedErr: session.ErrTokenRevoked,
+		},
+		{
+			name:              "token endpoint is down",
+			usess:             session.UserSession{AccessToken: "unknown"},
+			expectedToken:     "unknown",
+			expectedCheckedAt: now,
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			server := newTokenServer()
+			defer server.Close()
+			jar, err := cookie.New(bytes.Repeat([]byte{1}, cookie.MinKeySize), true)
+			is.NoErr(err)
+			logger := logrus.New()
+			logger.Out = ioutil.Discard
+			client := indieauth.NewClient(session.NewMemorySessionStore(), jar, logger)
+
+			usess := tt.usess
+			usess.Uid = "session-1"
+			usess.ExpiresAt = now.Add(time.Hour)
+			usess.TokenEndpoint = server.URL + "/token"
+			if tt.introspect {
+				usess.IntrospectionEndpoint = server.URL + "/introspect"
+			}
+
+			// act
+			result, err := client.RefreshIfNeeded(usess, now)
+
+			// assert
+			is.Equal(err, tt.expectedErr)
+			if tt.expectedErr != nil {
+				return
+			}
+			is.Equal(result.AccessToken, tt.expectedToken)
+			is.Equal(result.RefreshToken, tt.expectedRefreshToken)
+			is.Equal(result.TokenCheckedAt, tt.expectedCheckedAt)
+		})
+	}
+}
+
+func newAccountsClient(t *testing.T, tokenEndpoint string) (indieauth.Client, cookie.Jar) {
+	jar, err := cookie.New(bytes.Repeat([]byte{1}, cookie.MinKeySize), true)
+	if err != nil {
+		t.Fatalf("failed to create jar: %s", err.Error())
+	}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	store := session.NewMemorySessionStore()
+	for i, me := range []string{"https://example.com/", "https://blog.example.org/"} {
+		err = store.Create(session.UserSession{
+			Uid:           fmt.Sprintf("session-%d", i+1),
+			Me:            me,
+			AccessToken:   "valid",
+			TokenEndpoint: tokenEndpoint,
+			ExpiresAt:     time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("failed to create session: %s", err.Error())
+		}
+	}
+	return indieauth.NewClient(store, jar, logger), jar
+}
+
+func cookieSessionIDs(jar cookie.Jar, setCookie string) []string {
+	r := httptest.NewRequest("GET", "/composer", nil)
+	r.Header.Set("Cookie", strings.Split(setCookie, ";")[0])
+	sessionIDs, _ := jar.SessionIDs(r)
+	return sessionIDs
+}
+
+func TestSwitchAccount(t *testing.T) {
+
+	var tests = []struct {
+		name               string
+		me                 string
+		expectedStatus     int
+		expectedSessionIDs []string
+	}{
+		{
+			name:               "other site",
+			me:                 "https://blog.example.org/",
+			expectedStatus:     http.StatusSeeOther,
+			expectedSessionIDs: []string{"session-2", "session-1"},
+		},
+		{
+			name:               "active site",
+			me:                 "https://example.com/",
+			expectedStatus:     http.StatusSeeOther,
+			expectedSessionIDs: []string{"session-1", "session-2"},
+		},
+		{
+			name:           "site the browser is not logged in to",
+			me:             "https://evil.example/",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			client, jar := newAccountsClient(t, "")
+
+			// act
+			result := client.SwitchAccount([]string{"session-1", "session-2"}, tt.me)
+
+			// assert
+			is.Equal(result.StatusCode, tt.expectedStatus)
+			if tt.expectedSessionIDs != nil {
+				is.Equal(cookieSessionIDs(jar, result.Headers["Set-Cookie"]), tt.expectedSessionIDs)
+			}
+		})
+	}
+}
+
+func TestLogoutKeepsOtherAccounts(t *testing.T) {
+
+	var tests = []struct {
+		name               string
+		sessionIDs         []string
+		expectedLocation   string
+		expectedSessionIDs []string
+	}{
+		{
+			name:               "other site stays logged in",
+			sessionIDs:         []string{"session-1", "session-2"},
+			expectedLocation:   "/composer",
+			expectedSessionIDs: []string{"session-2"},
+		},
+		{
+			name:             "last site",
+			sessionIDs:       []string{"session-1"},
+			expectedLocation: "/login",
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			server := newTokenServer()
+			defer server.Close()
+			client, jar := newAccountsClient(t, server.URL+"/token")
+
+			// act
+			result := client.Logout(tt.sessionIDs)
+
+			// assert
+			is.Equal(result.StatusCode, http.StatusSeeOther)
+			is.Equal(result.Headers["Location"], tt.expectedLocation)
+			is.Equal(cookieSessionIDs(jar, result.Headers["Set-Cookie"]), tt.expectedSessionIDs)
+		})
+	}
+}
@@ -6,14 +6,18 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/j4y_funabashi/inari-admin/pkg/auth"
+	"github.com/j4y_funabashi/inari-admin/pkg/cookie"
 	"github.com/j4y_funabashi/inari-admin/pkg/indieauth"
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
 	"github.com/sirupsen/logrus"
 )
 
-func NewServer(logger *logrus.Logger, authClient indieauth.Client, clientID, redirectURL string) server {
+func NewServer(logger *logrus.Logger, authClient indieauth.Client, cookies cookie.Jar, clientID, redirectURL string) server {
 	s := server{
 		logger:      logger,
 		authClient:  authClient,
+		cookies:     cookies,
 		clientID:    clientID,
 		redirectURL: redirectURL,
 	}
@@ -23,6 +27,7 @@ func NewServer(logger *logrus.Logger, authClient indieauth.Client, clientID, red
 type server struct {
 	logger      *logrus.Logger
 	authClient  indieauth.Client
+	cookies     cookie.Jar
 	redirectURL string
 	clientID    string
 }
@@ -37,11 +42,16 @@ func (s *server) Routes(router *mux.Router) {
 	router.HandleFunc("/login", s.HandleLogin())
 	router.HandleFunc("/login-init", s.HandleLoginInit())
 	router.HandleFunc("/login-callback", s.HandleLoginCallback())
+	router.HandleFunc("/logout", s.HandleLogout()).Methods("POST")
+	router.HandleFunc("/accounts/switch", s.HandleSwitchAccount()).Methods("POST")
 }
 
 func (s *server) HandleLogin() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		response := s.ShowLoginForm()
+		response := s.ShowLoginForm(
+			r.URL.Query().Get("return_to"),
+			r.URL.Query().Get("reason"),
+		)
 		for k, v := range response.Headers {
 			w.Header().Set(k, v)
 		}
@@ -65,8 +75,12 @@ func (s *server) HandleLoginCallback() http.HandlerFunc {
 
 		state := r.Form.Get("state")
 		code := r.Form.Get("code")
+		iss := r.Form.Get("iss")
 
-		response := s.LoginCallback(state, code)
+		// sites the browser is already logged in to stay logged in
+		sessionIDs, _ := s.cookies.SessionIDs(r)
+
+		response := s.LoginCallback(state, code, iss, sessionIDs)
 
 		for k, v := range response.Headers {
 			w.Header().Set(k, v)
@@ -79,9 +93,37 @@ func (s *server) HandleLoginCallback() http.HandlerFunc {
 func (s *server) HandleLoginInit() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		me := r.FormValue("me")
+		err := r.ParseForm()
+		if err != nil {
+			s.logger.WithError(err).Error("failed to parse form")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		me := r.Form.Get("me")
+		scope := session.ParseScope(r.Form["scope"])
+		returnTo := r.Form.Get("return_to")
+
+		response := s.InitLogin(me, scope, returnTo)
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+func (s *server) HandleLogout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		sessionIDs, err := s.cookies.SessionIDs(r)
+		if err != nil {
+			s.logger.Infof("redirecting, could not find sessionid cookie")
+			w.Header().Set("Location", "/login")
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		}
 
-		response := s.InitLogin(me)
+		response := s.Logout(sessionIDs)
 		for k, v := range response.Headers {
 			w.Header().Set(k, v)
 		}
@@ -90,7 +132,27 @@ func (s *server) HandleLoginInit() http.HandlerFunc {
 	}
 }
 
-func (s *server) ShowLoginForm() HttpResponse {
+func (s *server) HandleSwitchAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		sessionIDs, err := s.cookies.SessionIDs(r)
+		if err != nil {
+			s.logger.Infof("redirecting, could not find sessionid cookie")
+			w.Header().Set("Location", "/login")
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		}
+
+		response := s.SwitchAccount(sessionIDs, r.PostFormValue("me"))
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+func (s *server) ShowLoginForm(returnTo, reason string) HttpResponse {
 	t, err := template.ParseFiles(
 		"view/components.html",
 		"view/layout.html",
@@ -103,8 +165,25 @@ func (s *server) ShowLoginForm() HttpResponse {
 		}
 	}
 
+	message := ""
+	if reason == auth.ReasonRevoked {
+		message = "Your login has expired or was revoked, log in again to continue"
+	}
+
 	w := new(bytes.Buffer)
-	v := struct{ PageTitle string }{PageTitle: "Login"}
+	v := struct {
+		PageTitle    string
+		Message      string
+		ReturnTo     string
+		Scopes       []string
+		DefaultScope string
+	}{
+		PageTitle:    "Login",
+		Message:      message,
+		ReturnTo:     auth.SafeReturnTo(returnTo),
+		Scopes:       session.Scopes,
+		DefaultScope: session.DefaultScope,
+	}
 	t.ExecuteTemplate(w, "layout", v)
 
 	headers := map[string]string{
@@ -118,16 +197,19 @@ func (s *server) ShowLoginForm() HttpResponse {
 	}
 }
 
-func (s *server) InitLogin(me string) HttpResponse {
+func (s *server) InitLogin(me, scope, returnTo string) HttpResponse {
 
 	s.logger.WithFields(logrus.Fields{
-		"me": me,
+		"me":    me,
+		"scope": scope,
 	}).Info("initializing login")
 
 	response := s.authClient.Init(
 		me,
 		s.clientID,
 		s.redirectURL,
+		scope,
+		auth.SafeReturnTo(returnTo),
 	)
 	s.logger.Infof("indieauth response %v", response)
 
@@ -138,12 +220,14 @@ func (s *server) InitLogin(me string) HttpResponse {
 	}
 }
 
-func (s *server) LoginCallback(state, code string) HttpResponse {
+func (s *server) LoginCallback(state, code, iss string, sessionIDs []string) HttpResponse {
 	response := s.authClient.Callback(
 		state,
 		code,
+		iss,
 		s.clientID,
 		s.redirectURL,
+		sessionIDs,
 	)
 	return HttpResponse{
 		StatusCode: response.StatusCode,
@@ -151,3 +235,21 @@ func (s *server) LoginCallback(state, code string) HttpResponse {
 		Body:       response.Body,
 	}
 }
+
+func (s *server) Logout(sessionIDs []string) HttpResponse {
+	response := s.authClient.Logout(sessionIDs)
+	return HttpResponse{
+		StatusCode: response.StatusCode,
+		Headers:    response.Headers,
+		Body:       response.Body,
+	}
+}
+
+func (s *server) SwitchAccount(sessionIDs []string, me string) HttpResponse {
+	response := s.authClient.SwitchAccount(sessionIDs, me)
+	return HttpResponse{
+		StatusCode: response.StatusCode,
+		Headers:    response.Headers,
+		Body:       response.Body,
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -37,6 +39,39 @@ func MfFromForm(formData map[string][]string) MicroFormat {
 	return newPost
 }
 
+// IsFlat returns true if every property value is a plain string, flat
+// posts can be sent as form encoded micropub requests
+func (mf MicroFormat) IsFlat() bool {
+	for _, values := range mf.Properties {
+		for _, v := range values {
+			if _, ok := v.(string); !ok {
+				return false
+			}
+		}
+	}
+	return len(mf.Children) == 0
+}
+
+// ToForm encodes the string properties of mf as micropub form data,
+// properties with multiple values use the key[] syntax
+func (mf MicroFormat) ToForm() url.Values {
+	formData := url.Values{}
+	for _, t := range mf.Type {
+		formData.Add("h", strings.TrimPrefix(t, "h-"))
+	}
+	for k, values := range mf.Properties {
+		strValues := mf.getStringSlice(k)
+		key := k
+		if len(values) > 1 {
+			key = k + "[]"
+		}
+		for _, v := range strValues {
+			formData.Add(key, v)
+		}
+	}
+	return formData
+}
+
 func MfFromJson(body string) (MicroFormat, error) {
 	var mf = MicroFormat{}
 	err := json.Unmarshal([]byte(body), &mf)
@@ -137,7 +172,7 @@ func (mf MicroFormat) ToView() MicroFormatView {
 	out.Summary = mf.getFirstString("summary")
 	out.Content = mf.parseContentValue()
 	out.Category = mf.getStringSlice("category")
-	out.Photo = mf.getStringSlice("photo")
+	out.Photo = mf.getURLSlice("photo")
 	out.Video = mf.getStringSlice("video")
 	out.Location = mf.getFirstString("location")
 	out.Author = mf.getFirstString("author")
@@ -150,6 +185,7 @@ func (mf MicroFormat) ToView() MicroFormatView {
 	out.Syndication = mf.getStringSlice("syndication")
 	out.InReplyTo = mf.getStringSlice("in-reply-to")
 	out.Comment = mf.getStringSlice("comment")
+	out.PostStatus = mf.getFirstString("post-status")
 
 	ym := parseYearMonth(mf.getFirstString("published"))
 	out.Archive = ym
@@ -197,6 +233,44 @@ func (mf MicroFormat) getStringSlice(key string) []string {
 	}
 	return o
 }
+
+// getURLSlice returns the urls of key, urls given as objects with alt text
+// use their value
+func (mf MicroFormat) getURLSlice(key string) []string {
+	var o []string
+	for _, v := range mf.Properties[key] {
+		switch p := v.(type) {
+		case string:
+			o = append(o, p)
+		case map[string]interface{}:
+			if value, ok := p["value"].(string); ok {
+				o = append(o, value)
+			}
+		}
+	}
+	return o
+}
+
+// ContentString returns the content of mf as it was written, html content
+// is not sanitised so it can be edited without losing markup
+func (mf MicroFormat) ContentString() string {
+	s := mf.getFirstString("content")
+	if s != "" {
+		return s
+	}
+	for _, v := range mf.Properties["content"] {
+		if p, ok := v.(map[string]interface{}); ok {
+			if o, htmlExists := p["html"].(string); htmlExists {
+				return o
+			}
+			if o, valueExists := p["value"].(string); valueExists {
+				return o
+			}
+		}
+	}
+	return ""
+}
+
 func (mf MicroFormat) parseContentValue() template.HTML {
 	s := mf.getFirstString("content")
 	if s != "" {
@@ -243,6 +317,7 @@ type MicroFormatView struct {
 	Video       []string          `json:"video,omitempty"`
 	Children    []MicroFormatView `json:"children,omitempty"`
 	Archive     string            `json:"archive,omitempty"`
+	PostStatus  string            `json:"post_status,omitempty"`
 }
 
 func (jf2 *MicroFormatView) SortChildren() {
@@ -374,3 +449,281 @@ func normalizeDate(d string) time.Time {
 	log.Printf("[E] Could not parse date format [ %v ]", d)
 	return time.Now()
 }
+
+// Update is a micropub update request, only changed properties are
+// included
+type Update struct {
+	Action  string                   `json:"action"`
+	URL     string                   `json:"url"`
+	Replace map[string][]interface{} `json:"replace,omitempty"`
+	Add     map[string][]interface{} `json:"add,omitempty"`
+	// Delete lists properties to remove completely
+	Delete []string `json:"-"`
+	// DeleteValues lists values to remove from properties, micropub has
+	// no way to send it in the same request as Delete
+	DeleteValues map[string][]interface{} `json:"-"`
+}
+
+// MarshalJSON sends Delete as a list of property names, or DeleteValues
+// as a map of values when no whole properties are deleted
+func (u Update) MarshalJSON() ([]byte, error) {
+	type fields Update
+	out := struct {
+		fields
+		Delete interface{} `json:"delete,omitempty"`
+	}{fields: fields(u)}
+	switch {
+	case len(u.Delete) > 0:
+		out.Delete = u.Delete
+	case len(u.DeleteValues) > 0:
+		out.Delete = u.DeleteValues
+	}
+	return json.Marshal(out)
+}
+
+// HasChanges returns true if the update will modify the post
+func (u Update) HasChanges() bool {
+	return len(u.Replace) > 0 || len(u.Add) > 0 || len(u.Delete) > 0 || len(u.DeleteValues) > 0
+}
+
+// EditableProperties are the properties that can be changed from the
+// edit screen
+var EditableProperties = []string{"content", "photo", "category", "location", "post-status"}
+
+// properties where individual values are added and deleted rather than
+// replacing the whole list
+var setProperties = map[string]bool{
+	"category": true,
+}
+
+// Diff compares mf with updated and builds an update request for url
+// containing only the properties that have changed
+func (mf MicroFormat) Diff(updated MicroFormat, url string) Update {
+	out := Update{
+		Action:       "update",
+		URL:          url,
+		Replace:      make(map[string][]interface{}),
+		Add:          make(map[string][]interface{}),
+		DeleteValues: make(map[string][]interface{}),
+	}
+
+	oldView := mf.withDefaultType().ToView()
+	newView := updated.withDefaultType().ToView()
+	changed := make(map[string][]string)
+
+	for _, property := range EditableProperties {
+		oldValues := viewValues(mf, oldView, property)
+		newValues := viewValues(updated, newView, property)
+
+		if stringSliceEqual(oldValues, newValues) {
+			continue
+		}
+		changed[property] = newValues
+
+		switch {
+		case len(newValues) == 0:
+			out.Delete = append(out.Delete, property)
+		case len(oldValues) == 0:
+			out.Add[property] = mf.updateValues(property, newValues)
+		case setProperties[property]:
+			for _, v := range stringSliceDiff(newValues, oldValues) {
+				out.Add[property] = append(out.Add[property], v)
+			}
+			for _, v := range stringSliceDiff(oldValues, newValues) {
+				out.DeleteValues[property] = append(out.DeleteValues[property], v)
+			}
+		default:
+			out.Replace[property] = mf.updateValues(property, newValues)
+		}
+	}
+
+	// both forms of delete can not be sent together, so properties losing
+	// some of their values are replaced instead
+	if len(out.Delete) > 0 {
+		for property := range out.DeleteValues {
+			delete(out.Add, property)
+			out.Replace[property] = toInterfaceSlice(changed[property])
+		}
+		out.DeleteValues = make(map[string][]interface{})
+	}
+
+	return out
+}
+
+// updateValues converts the edited values of property back to the form
+// mf uses, html content stays html and locations are rebuilt as
+// structured values
+func (mf MicroFormat) updateValues(property string, values []string) []interface{} {
+	switch property {
+	case "content":
+		if mf.hasHTMLContent() {
+			return []interface{}{map[string]interface{}{"html": values[0]}}
+		}
+	case "location":
+		return []interface{}{locationValue(values[0])}
+	case "photo":
+		out := []interface{}{}
+		for _, v := range values {
+			out = append(out, mf.photoValue(v))
+		}
+		return out
+	}
+	return toInterfaceSlice(values)
+}
+
+// photoValue returns the photo of mf with the url u, so photos with alt
+// text keep it, or u when it is a new photo
+func (mf MicroFormat) photoValue(u string) interface{} {
+	for _, v := range mf.Properties["photo"] {
+		if p, ok := v.(map[string]interface{}); ok && p["value"] == u {
+			return p
+		}
+	}
+	return u
+}
+
+func (mf MicroFormat) hasHTMLContent() bool {
+	for _, v := range mf.Properties["content"] {
+		if p, ok := v.(map[string]interface{}); ok {
+			if _, htmlExists := p["html"]; htmlExists {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LocationString returns the location of mf as text that can be edited,
+// nested h-cards, h-adrs and h-geos with coordinates become a geo url
+func (mf MicroFormat) LocationString() string {
+	for _, v := range mf.Properties["location"] {
+		switch loc := v.(type) {
+		case string:
+			return loc
+		case map[string]interface{}:
+			properties, _ := loc["properties"].(map[string]interface{})
+			lat := firstValue(properties["latitude"])
+			lng := firstValue(properties["longitude"])
+			if lat != "" && lng != "" {
+				return "geo:" + lat + "," + lng
+			}
+			if name := firstValue(properties["name"]); name != "" {
+				return name
+			}
+			if locality := firstValue(properties["locality"]); locality != "" {
+				return locality
+			}
+		}
+	}
+	return ""
+}
+
+// firstValue returns the first value of a property decoded from json
+func firstValue(property interface{}) string {
+	values, ok := property.([]interface{})
+	if !ok || len(values) == 0 {
+		return ""
+	}
+	switch v := values[0].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// locationValue builds a nested h-geo from a geo url, or an h-card named
+// after any other text
+func locationValue(text string) map[string]interface{} {
+	if strings.HasPrefix(text, "geo:") {
+		coords := strings.Split(strings.SplitN(strings.TrimPrefix(text, "geo:"), ";", 2)[0], ",")
+		if len(coords) >= 2 {
+			lat, latErr := strconv.ParseFloat(strings.TrimSpace(coords[0]), 64)
+			lng, lngErr := strconv.ParseFloat(strings.TrimSpace(coords[1]), 64)
+			if latErr == nil && lngErr == nil {
+				return map[string]interface{}{
+					"type": []string{"h-geo"},
+					"properties": map[string][]interface{}{
+						"latitude":  []interface{}{lat},
+						"longitude": []interface{}{lng},
+					},
+				}
+			}
+		}
+	}
+	return map[string]interface{}{
+		"type": []string{"h-card"},
+		"properties": map[string][]interface{}{
+			"name": []interface{}{text},
+		},
+	}
+}
+
+func (mf MicroFormat) withDefaultType() MicroFormat {
+	if len(mf.Type) == 0 {
+		mf.Type = []string{"h-entry"}
+	}
+	return mf
+}
+
+func viewValues(mf MicroFormat, view MicroFormatView, property string) []string {
+	switch property {
+	case "content":
+		// browsers send textareas with crlf line endings
+		if content := strings.Replace(mf.ContentString(), "\r\n", "\n", -1); content != "" {
+			return []string{content}
+		}
+	case "location":
+		if location := mf.LocationString(); location != "" {
+			return []string{location}
+		}
+	case "post-status":
+		if view.PostStatus != "" {
+			return []string{view.PostStatus}
+		}
+	case "photo":
+		return view.Photo
+	case "category":
+		return view.Category
+	}
+	return nil
+}
+
+func stringSliceEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// stringSliceDiff returns the values in a that are not in b
+func stringSliceDiff(a, b []string) []string {
+	var out []string
+	for _, v := range a {
+		found := false
+		for _, o := range b {
+			if v == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func toInterfaceSlice(values []string) []interface{} {
+	out := []interface{}{}
+	for _, v := range values {
+		out = append(out, v)
+	}
+	return out
+}
@@ -0,0 +1,338 @@
+package mf2_test
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/mf2"
+	"github.com/matryer/is"
+)
+
+func TestDiff(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		old      mf2.MicroFormat
+		new      mf2.MicroFormat
+		expected mf2.Update
+	}{
+		{
+			name: "unchanged post has no changes",
+			old:  newPost(map[string][]interface{}{"content": {"hello"}}),
+			new:  newPost(map[string][]interface{}{"content": {"hello"}}),
+			expected: mf2.Update{
+				Replace:      map[string][]interface{}{},
+				Add:          map[string][]interface{}{},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+		{
+			name: "changed content is replaced",
+			old:  newPost(map[string][]interface{}{"content": {"hello"}}),
+			new:  newPost(map[string][]interface{}{"content": {"hello world"}}),
+			expected: mf2.Update{
+				Replace:      map[string][]interface{}{"content": {"hello world"}},
+				Add:          map[string][]interface{}{},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+		{
+			name: "new location is added as an h-geo",
+			old:  newPost(map[string][]interface{}{}),
+			new:  newPost(map[string][]interface{}{"location": {"geo:1,2"}}),
+			expected: mf2.Update{
+				Replace: map[string][]interface{}{},
+				Add: map[string][]interface{}{
+					"location": {map[string]interface{}{
+						"type": []string{"h-geo"},
+						"properties": map[string][]interface{}{
+							"latitude":  {1.0},
+							"longitude": {2.0},
+						},
+					}},
+				},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+		{
+			name: "removed property is deleted",
+			old:  newPost(map[string][]interface{}{"photo": {"http://example.com/1.jpg"}}),
+			new:  newPost(map[string][]interface{}{}),
+			expected: mf2.Update{
+				Replace:      map[string][]interface{}{},
+				Add:          map[string][]interface{}{},
+				Delete:       []string{"photo"},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+		{
+			name: "categories are added and deleted individually",
+			old:  newPost(map[string][]interface{}{"category": {"cats", "dogs"}}),
+			new:  newPost(map[string][]interface{}{"category": {"dogs", "birds"}}),
+			expected: mf2.Update{
+				Replace:      map[string][]interface{}{},
+				Add:          map[string][]interface{}{"category": {"birds"}},
+				DeleteValues: map[string][]interface{}{"category": {"cats"}},
+			},
+		},
+		{
+			name: "publishing a draft replaces post-status",
+			old:  newPost(map[string][]interface{}{"post-status": {"draft"}}),
+			new:  newPost(map[string][]interface{}{"post-status": {"published"}}),
+			expected: mf2.Update{
+				Replace:      map[string][]interface{}{"post-status": {"published"}},
+				Add:          map[string][]interface{}{},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+		{
+			name: "removed html content is deleted by name",
+			old: newPost(map[string][]interface{}{
+				"content": {map[string]interface{}{"html": "<b>hello</b>"}},
+			}),
+			new: newPost(map[string][]interface{}{}),
+			expected: mf2.Update{
+				Replace:      map[string][]interface{}{},
+				Add:          map[string][]interface{}{},
+				Delete:       []string{"content"},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+		{
+			name: "categories are replaced when a property is also deleted",
+			old: newPost(map[string][]interface{}{
+				"category": {"cats", "dogs"},
+				"photo":    {"http://example.com/1.jpg"},
+			}),
+			new: newPost(map[string][]interface{}{"category": {"dogs"}}),
+			expected: mf2.Update{
+				Replace:      map[string][]interface{}{"category": {"dogs"}},
+				Add:          map[string][]interface{}{},
+				Delete:       []string{"photo"},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+		{
+			name: "changed html content stays html",
+			old: newPost(map[string][]interface{}{
+				"content": {map[string]interface{}{"html": "<b>hello</b>", "value": "hello"}},
+			}),
+			new: newPost(map[string][]interface{}{"content": {"<b>hello world</b>"}}),
+			expected: mf2.Update{
+				Replace: map[string][]interface{}{
+					"content": {map[string]interface{}{"html": "<b>hello world</b>"}},
+				},
+				Add:          map[string][]interface{}{},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+		{
+			name: "unchanged structured location is left alone",
+			old: newPost(map[string][]interface{}{
+				"location": {map[string]interface{}{
+					"type": []interface{}{"h-adr"},
+					"properties": map[string]interface{}{
+						"latitude":  []interface{}{53.8},
+						"longitude": []interface{}{-1.5},
+						"locality":  []interface{}{"Leeds"},
+					},
+				}},
+			}),
+			new: newPost(map[string][]interface{}{"location": {"geo:53.8,-1.5"}}),
+			expected: mf2.Update{
+				Replace:      map[string][]interface{}{},
+				Add:          map[string][]interface{}{},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+		{
+			name: "changed location is rebuilt as an h-geo",
+			old:  newPost(map[string][]interface{}{"location": {"geo:53.8,-1.5"}}),
+			new:  newPost(map[string][]interface{}{"location": {"geo:51.5,-0.1"}}),
+			expected: mf2.Update{
+				Replace: map[string][]interface{}{
+					"location": {map[string]interface{}{
+						"type": []string{"h-geo"},
+						"properties": map[string][]interface{}{
+							"latitude":  {51.5},
+							"longitude": {-0.1},
+						},
+					}},
+				},
+				Add:          map[string][]interface{}{},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+		{
+			name: "unchanged html content sent back by a browser has no changes",
+			old: newPost(map[string][]interface{}{
+				"content": {map[string]interface{}{
+					"html":  "<p class=\"intro\" onclick=\"go()\">hello</p>\n<p>world</p>",
+					"value": "hello world",
+				}},
+			}),
+			new: newPost(map[string][]interface{}{
+				"content": {"<p class=\"intro\" onclick=\"go()\">hello</p>\r\n<p>world</p>"},
+			}),
+			expected: mf2.Update{
+				Replace:      map[string][]interface{}{},
+				Add:          map[string][]interface{}{},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+		{
+			name: "changed multi-line content is sent with unix line endings",
+			old:  newPost(map[string][]interface{}{"content": {"hello\nworld"}}),
+			new:  newPost(map[string][]interface{}{"content": {"hello\r\nthere"}}),
+			expected: mf2.Update{
+				Replace:      map[string][]interface{}{"content": {"hello\nthere"}},
+				Add:          map[string][]interface{}{},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+		{
+			name: "photos with alt text are kept when a photo is added",
+			old: newPost(map[string][]interface{}{
+				"photo": {map[string]interface{}{"value": "http://example.com/1.jpg", "alt": "a cat"}},
+			}),
+			new: newPost(map[string][]interface{}{
+				"photo": {"http://example.com/1.jpg", "http://example.com/2.jpg"},
+			}),
+			expected: mf2.Update{
+				Replace: map[string][]interface{}{
+					"photo": {
+						map[string]interface{}{"value": "http://example.com/1.jpg", "alt": "a cat"},
+						"http://example.com/2.jpg",
+					},
+				},
+				Add:          map[string][]interface{}{},
+				DeleteValues: map[string][]interface{}{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			postURL := "http://example.com/post/1"
+			tt.expected.Action = "update"
+			tt.expected.URL = postURL
+
+			// act
+			result := tt.old.Diff(tt.new, postURL)
+
+			// assert
+			is.Equal(result, tt.expected)
+		})
+	}
+}
+
+func TestUpdateMarshalJSON(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		update   mf2.Update
+		expected string
+	}{
+		{
+			name: "deleted properties are sent as a list",
+			update: mf2.Update{
+				Action: "update",
+				URL:    "http://example.com/post/1",
+				Delete: []string{"content"},
+			},
+			expected: `{"action":"update","url":"http://example.com/post/1","delete":["content"]}`,
+		},
+		{
+			name: "deleted values are sent as a map",
+			update: mf2.Update{
+				Action:       "update",
+				URL:          "http://example.com/post/1",
+				DeleteValues: map[string][]interface{}{"category": {"cats"}},
+			},
+			expected: `{"action":"update","url":"http://example.com/post/1","delete":{"category":["cats"]}}`,
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			result, err := json.Marshal(tt.update)
+
+			// assert
+			is.NoErr(err)
+			is.Equal(string(result), tt.expected)
+		})
+	}
+}
+
+func TestToForm(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		post     mf2.MicroFormat
+		isFlat   bool
+		expected url.Values
+	}{
+		{
+			name:   "simple note is form encoded",
+			post:   newPost(map[string][]interface{}{"content": {"hello"}}),
+			isFlat: true,
+			expected: url.Values{
+				"h":       []string{"entry"},
+				"content": []string{"hello"},
+			},
+		},
+		{
+			name:   "multiple values use array syntax",
+			post:   newPost(map[string][]interface{}{"category": {"cats", "dogs"}}),
+			isFlat: true,
+			expected: url.Values{
+				"h":          []string{"entry"},
+				"category[]": []string{"cats", "dogs"},
+			},
+		},
+		{
+			name: "html content is not flat",
+			post: newPost(map[string][]interface{}{
+				"content": {map[string]interface{}{"html": "<b>hello</b>"}},
+			}),
+			isFlat: false,
+			expected: url.Values{
+				"h": []string{"entry"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			isFlat := tt.post.IsFlat()
+			result := tt.post.ToForm()
+
+			// assert
+			is.Equal(isFlat, tt.isFlat)
+			is.Equal(result, tt.expected)
+		})
+	}
+}
+
+func newPost(properties map[string][]interface{}) mf2.MicroFormat {
+	return mf2.MicroFormat{
+		Type:       []string{"h-entry"},
+		Properties: properties,
+	}
+}
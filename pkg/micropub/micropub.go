@@ -3,9 +3,11 @@ package micropub
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/url"
@@ -14,33 +16,63 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/j4y_funabashi/inari-admin/pkg/auth"
+	"github.com/j4y_funabashi/inari-admin/pkg/cookie"
+	"github.com/j4y_funabashi/inari-admin/pkg/deleted"
 	"github.com/j4y_funabashi/inari-admin/pkg/mf2"
 	"github.com/j4y_funabashi/inari-admin/pkg/mpclient"
 	"github.com/j4y_funabashi/inari-admin/pkg/okami"
+	"github.com/j4y_funabashi/inari-admin/pkg/outbox"
 	"github.com/j4y_funabashi/inari-admin/pkg/session"
 	"github.com/j4y_funabashi/inari-admin/pkg/view"
+	"github.com/russross/blackfriday"
 	"github.com/sirupsen/logrus"
 )
 
 type MPClient interface {
 	UploadToMediaServer(uploadedFile UploadedFile, usess session.UserSession) (MediaEndpointResponse, error)
 	SendRequest(body url.Values, endpoint, bearerToken string) (MicropubEndpointResponse, error)
-	QueryPostList(micropubEndpoint, accessToken, afterKey string) (mf2.PostList, error)
+	SendJSONRequest(post mf2.MicroFormat, mpEndpoint, bearerToken string) (MicropubEndpointResponse, error)
+	QueryPostList(micropubEndpoint, accessToken, afterKey, postStatus string) (mf2.PostList, error)
 	QueryYearsList(micropubEndpoint, accessToken string) ([]mf2.ArchiveYear, error)
 	QueryMediaList(mediaEndpoint, accessToken, afterKey, year, month string) (mpclient.MediaQueryListResponse, error)
 	QueryMediaURL(URL, mediaEndpoint, accessToken string) (mpclient.MediaQueryListResponseItem, error)
+	QuerySource(micropubEndpoint, accessToken, postURL string) (mf2.MicroFormat, error)
+	SendUpdate(update mf2.Update, mpEndpoint, bearerToken string) (MicropubEndpointResponse, error)
+	QueryCategories(micropubEndpoint, accessToken string) ([]string, error)
+	QuerySyndicateTo(micropubEndpoint, accessToken string) ([]session.SyndicationTarget, error)
+	Delete(postURL, mpEndpoint, bearerToken string) (MicropubEndpointResponse, error)
+	Undelete(postURL, mpEndpoint, bearerToken string) (MicropubEndpointResponse, error)
 }
 
 type GeoCoder interface {
 	Lookup(address string) []session.Location
 }
 
+// FallbackGeoCoder asks each geocoder in turn until one finds a location,
+// so a free or local geocoder can be used when a paid one fails
+type FallbackGeoCoder []GeoCoder
+
+func (geocoders FallbackGeoCoder) Lookup(address string) []session.Location {
+	for _, geocoder := range geocoders {
+		locations := geocoder.Lookup(address)
+		if len(locations) > 0 {
+			return locations
+		}
+	}
+	return []session.Location{}
+}
+
 func NewServer(
 	logger *logrus.Logger,
 	ss session.SessionStore,
 	client MPClient,
 	geocoder GeoCoder,
 	app okami.Server,
+	ob outbox.Store,
+	dp deleted.Store,
+	cookies cookie.Jar,
+	tokens auth.TokenRefresher,
 ) server {
 	s := server{
 		logger:       logger,
@@ -48,6 +80,10 @@ func NewServer(
 		client:       client,
 		geocoder:     geocoder,
 		app:          app,
+		outbox:       ob,
+		deleted:      dp,
+		cookies:      cookies,
+		tokens:       tokens,
 	}
 	return s
 }
@@ -58,6 +94,10 @@ type server struct {
 	client       MPClient
 	geocoder     GeoCoder
 	app          okami.Server
+	outbox       outbox.Store
+	deleted      deleted.Store
+	cookies      cookie.Jar
+	tokens       auth.TokenRefresher
 }
 
 type HttpResponse struct {
@@ -67,33 +107,32 @@ type HttpResponse struct {
 }
 
 func (s *server) Routes(router *mux.Router) {
-	router.HandleFunc("/composer", s.HandleComposerForm())
-	router.HandleFunc("/composer/addlocation", s.HandleAddLocationForm())
-	router.HandleFunc("/submit", s.HandleSubmit())
-	router.HandleFunc("/composer/media", s.HandleAddMediaToComposer()).Methods("POST")
-	router.HandleFunc("/composer/media/device", s.HandleAddPhotoForm())
-	router.HandleFunc("/composer/media/gallery", s.HandleQueryMedia())
-	router.HandleFunc("/queryposts", s.HandleQueryPosts())
+	requireLogin := auth.Middleware(s.SessionStore, s.cookies, s.tokens, s.logger)
+
+	router.Handle("/composer", requireLogin(s.HandleComposerForm()))
+	router.Handle("/profile/refresh", requireLogin(s.HandleRefreshProfile())).Methods("POST")
+	router.Handle("/composer/addlocation", requireLogin(s.HandleAddLocationForm()))
+	router.Handle("/composer/addcategory", requireLogin(s.HandleAddCategoryForm()))
+	router.Handle("/composer/removecategory", requireLogin(s.HandleRemoveCategory())).Methods("POST")
+	router.Handle("/submit", requireLogin(s.HandleSubmit()))
+	router.Handle("/composer/media", requireLogin(s.HandleAddMediaToComposer())).Methods("POST")
+	router.Handle("/composer/media/device", requireLogin(s.HandleAddPhotoForm()))
+	router.Handle("/composer/media/gallery", requireLogin(s.HandleQueryMedia()))
+	router.Handle("/queryposts", requireLogin(s.HandleQueryPosts()))
+	router.Handle("/edit", requireLogin(s.HandleEditPostForm()))
+	router.Handle("/delete", requireLogin(s.HandleDeletePostForm()))
+	router.Handle("/deleted", requireLogin(s.HandleDeletedPosts()))
+	router.Handle("/undelete", requireLogin(s.HandleUndeletePost())).Methods("POST")
+	router.Handle("/outbox", requireLogin(s.HandleOutbox()))
+	router.Handle("/outbox/edit", requireLogin(s.HandleEditOutboxItemForm()))
+	router.Handle("/outbox/retry", requireLogin(s.HandleRetryOutboxItem())).Methods("POST")
+	router.Handle("/outbox/discard", requireLogin(s.HandleDiscardOutboxItem())).Methods("POST")
 }
 
 func (s *server) HandleQueryMedia() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		// fetch cookie
-		cookie, err := r.Cookie("sessionid")
-		if err != nil {
-			s.logger.WithError(err).Info("could not find sessionid cookie")
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-		// fetch session
-		usess, err := s.SessionStore.FetchByID(cookie.Value)
-		if err != nil {
-			s.logger.WithError(err).Info("could not find session")
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-		s.logger.WithField("user", usess).Info("logged in user")
+		usess := auth.CurrentSession(r)
 
 		mediaURL := r.URL.Query().Get("url")
 		outBuf := new(bytes.Buffer)
@@ -118,7 +157,7 @@ func (s *server) HandleQueryMedia() http.HandlerFunc {
 				Lat:      mediaResponse.Lat,
 				Lng:      mediaResponse.Lng,
 			}
-			err = view.RenderMediaPreview(viewModel, outBuf)
+			err = view.RenderMediaPreview(viewModel, usess.Accounts(), usess.CSRFToken, outBuf)
 			if err != nil {
 				s.logger.WithError(err).Error("failed to parse template files")
 				w.WriteHeader(http.StatusInternalServerError)
@@ -139,10 +178,11 @@ func (s *server) HandleQueryMedia() http.HandlerFunc {
 				selectedMonth,
 			)
 
+			var err error
 			if selectedDay == "" {
-				err = view.RenderMediaList(mediaResponse, outBuf)
+				err = view.RenderMediaList(mediaResponse, usess.Accounts(), usess.CSRFToken, outBuf)
 			} else {
-				err = view.RenderMediaDay(mediaResponse, selectedDay, outBuf)
+				err = view.RenderMediaDay(mediaResponse, selectedDay, usess.Accounts(), usess.CSRFToken, outBuf)
 			}
 
 			if err != nil {
@@ -161,23 +201,7 @@ func (s *server) HandleQueryMedia() http.HandlerFunc {
 func (s *server) HandleAddMediaToComposer() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		// fetch cookie
-		cookie, err := r.Cookie("sessionid")
-		if err != nil {
-			s.logger.WithError(err).Info("could not find sessionid cookie")
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		// fetch session
-		usess, err := s.SessionStore.FetchByID(cookie.Value)
-		if err != nil {
-			s.logger.WithError(err).Info("could not find session")
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		s.logger.WithField("user", usess).Info("logged in user")
+		usess := auth.CurrentSession(r)
 
 		lat, err := strconv.ParseFloat(r.FormValue("lat"), 64)
 		if err != nil {
@@ -208,26 +232,12 @@ func (s *server) HandleAddMediaToComposer() http.HandlerFunc {
 func (s *server) HandleQueryPosts() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		// fetch cookie
-		cookie, err := r.Cookie("sessionid")
-		if err != nil {
-			s.logger.WithError(err).Info("could not find sessionid cookie")
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		// fetch session
-		usess, err := s.SessionStore.FetchByID(cookie.Value)
-		if err != nil {
-			s.logger.WithError(err).Info("could not find session")
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-		s.logger.WithField("user", usess).Info("logged in user")
+		usess := auth.CurrentSession(r)
 
 		// query post list
 		afterKey := r.URL.Query().Get("after")
-		postList, err := s.client.QueryPostList(usess.MicropubEndpoint, usess.AccessToken, afterKey)
+		postStatus := r.URL.Query().Get("post-status")
+		postList, err := s.client.QueryPostList(usess.MicropubEndpoint, usess.AccessToken, afterKey, postStatus)
 		if err != nil {
 			s.logger.WithError(err).Info("failed to query postlist")
 			w.WriteHeader(http.StatusInternalServerError)
@@ -265,17 +275,25 @@ func (s *server) HandleQueryPosts() http.HandlerFunc {
 
 		outBuf := new(bytes.Buffer)
 		v := struct {
-			PageTitle string
-			PostList  []mf2.MicroFormatView
-			HasPaging bool
-			AfterKey  string
-			YearsList []mf2.ArchiveYear
+			PageTitle  string
+			PostList   []mf2.MicroFormatView
+			HasPaging  bool
+			AfterKey   string
+			PostStatus string
+			YearsList  []mf2.ArchiveYear
+			Can        session.Permissions
+			Accounts   session.Accounts
+			CSRFToken  string
 		}{
-			PageTitle: "LATEST POSTS",
-			PostList:  postListView,
-			HasPaging: postList.Paging != nil,
-			AfterKey:  afterKey,
-			YearsList: yearsList,
+			PageTitle:  "LATEST POSTS",
+			PostList:   postListView,
+			HasPaging:  postList.Paging != nil,
+			AfterKey:   afterKey,
+			PostStatus: postStatus,
+			YearsList:  yearsList,
+			Can:        usess.Permissions(),
+			Accounts:   usess.Accounts(),
+			CSRFToken:  usess.CSRFToken,
 		}
 		t.ExecuteTemplate(outBuf, "layout", v)
 
@@ -285,122 +303,202 @@ func (s *server) HandleQueryPosts() http.HandlerFunc {
 	}
 }
 
-func (s *server) HandleSubmit() http.HandlerFunc {
+func (s *server) HandleEditPostForm() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		cookie, err := r.Cookie("sessionid")
-		if err != nil {
-			s.logger.Infof("redirecting, could not find sessionid cookie")
-			w.Header().Set("Location", "/login")
-			w.WriteHeader(http.StatusSeeOther)
-			return
-		}
+		usess := auth.CurrentSession(r)
 
-		s.SubmitPost(
-			cookie.Value,
-			r.FormValue("content"),
-			r.FormValue("h"),
-		)
+		response := HttpResponse{}
 
-		w.Header().Set("Location", "/composer")
-		w.WriteHeader(http.StatusSeeOther)
+		switch r.Method {
+		case "GET":
+			response = s.ShowEditPostForm(
+				usess,
+				r.URL.Query().Get("url"),
+			)
+		case "POST":
+			response = s.UpdatePost(
+				usess,
+				r.FormValue("url"),
+				r.FormValue("content"),
+				r.FormValue("photo"),
+				r.FormValue("category"),
+				r.FormValue("location"),
+				r.FormValue("post-status"),
+			)
+		}
+
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
 	}
 }
 
-func (s *server) SubmitPost(
-	sessionid,
-	content,
-	h string,
-) HttpResponse {
+func (s *server) ShowEditPostForm(usess session.UserSession, postURL string) HttpResponse {
+
+	// fetch post
+	post, err := s.client.QuerySource(usess.MicropubEndpoint, usess.AccessToken, postURL)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to query post source")
+		return HttpResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       err.Error(),
+		}
+	}
+	if len(post.Type) == 0 {
+		post.Type = []string{"h-entry"}
+	}
+	postView := post.ToView()
 
-	// fetch session
-	usess, err := s.SessionStore.FetchByID(sessionid)
+	// render
+	t, err := template.ParseFiles(
+		"view/components.html",
+		"view/layout.html",
+		"view/editpost.html",
+	)
 	if err != nil {
 		return HttpResponse{
 			StatusCode: http.StatusInternalServerError,
 			Body:       err.Error(),
 		}
 	}
-	s.logger.WithFields(logrus.Fields{"user": usess}).Info("logged in user")
 
-	// build POST body
-	formData := url.Values{}
-	formData.Add("content", content)
-	formData.Add("h", h)
-	for _, photo := range usess.ComposerData.Photos {
-		formData.Add("photo", photo.URL)
+	w := new(bytes.Buffer)
+	v := struct {
+		PageTitle string
+		CSRFToken string
+		URL       string
+		Post      mf2.MicroFormatView
+		Content   string
+		Photos    string
+		Category  string
+		Location  string
+		Accounts  session.Accounts
+	}{
+		PageTitle: "Edit Post",
+		CSRFToken: usess.CSRFToken,
+		URL:       postURL,
+		Post:      postView,
+		Content:   post.ContentString(),
+		Photos:    strings.Join(postView.Photo, "\n"),
+		Category:  strings.Join(postView.Category, ", "),
+		Location:  post.LocationString(),
+		Accounts:  usess.Accounts(),
 	}
+	t.ExecuteTemplate(w, "layout", v)
 
-	published := time.Now().Format(time.RFC3339)
-	if usess.ComposerData.Published != "" {
-		published = usess.ComposerData.Published
+	headers := map[string]string{
+		"Content-Type": "text/html; charset=UTF-8",
 	}
-	formData.Add("published", published)
-	if usess.ComposerData.Location.HasLatLng() {
-		formData.Add("location", usess.ComposerData.Location.ToGeoURL())
+	return HttpResponse{
+		StatusCode: http.StatusOK,
+		Body:       w.String(),
+		Headers:    headers,
 	}
+}
 
-	s.logger.WithFields(logrus.Fields{"request": formData}).Info("built micropub request")
+func (s *server) UpdatePost(usess session.UserSession, postURL, content, photos, category, location, postStatus string) HttpResponse {
 
-	mpResponse, err := s.client.SendRequest(formData, usess.MicropubEndpoint, usess.AccessToken)
+	// fetch current version of post
+	post, err := s.client.QuerySource(usess.MicropubEndpoint, usess.AccessToken, postURL)
 	if err != nil {
-		s.logger.WithError(err).Error("failed to send MP request")
+		s.logger.WithError(err).Error("failed to query post source")
 		return HttpResponse{
-			StatusCode: http.StatusInternalServerError,
+			StatusCode: http.StatusNotFound,
 			Body:       err.Error(),
 		}
 	}
 
-	// TODO redirect with message if not successful
-	// TODO only clear session if successful
-	usess.ClearComposerData()
-	s.SessionStore.Create(usess)
+	// build updated post from form
+	updated := mf2.MicroFormat{Type: post.Type}
+	if strings.TrimSpace(content) != "" {
+		updated.AddProperty("content", content)
+	}
+	for _, photo := range splitFields(photos, "\n") {
+		updated.AddProperty("photo", photo)
+	}
+	for _, c := range splitFields(category, ",") {
+		updated.AddProperty("category", c)
+	}
+	if strings.TrimSpace(location) != "" {
+		updated.AddProperty("location", strings.TrimSpace(location))
+	}
+	if postStatus != "" {
+		updated.AddProperty("post-status", postStatus)
+	}
 
-	// redirect
+	update := post.Diff(updated, postURL)
 	headers := map[string]string{
-		"Location": mpResponse.Location,
+		"Location": "/queryposts",
+	}
+	if postStatus == session.PostStatusDraft {
+		headers["Location"] = "/queryposts?post-status=" + session.PostStatusDraft
+	}
+	if !update.HasChanges() {
+		s.logger.WithField("url", postURL).Info("post unchanged, skipping update")
+		return HttpResponse{
+			StatusCode: http.StatusSeeOther,
+			Headers:    headers,
+		}
+	}
+
+	mpResponse, err := s.client.SendUpdate(update, usess.MicropubEndpoint, usess.AccessToken)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to send MP update request")
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+	if !mpResponse.IsSuccess() {
+		return HttpResponse{
+			StatusCode: http.StatusBadGateway,
+			Body:       mpResponse.ErrorMessage(),
+		}
 	}
+
 	return HttpResponse{
-		StatusCode: mpResponse.StatusCode,
+		StatusCode: http.StatusSeeOther,
 		Headers:    headers,
 	}
 }
 
-func (s *server) HandleAddPhotoForm() http.HandlerFunc {
+func (s *server) HandleDeletePostForm() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		cookie, err := r.Cookie("sessionid")
-		if err != nil {
-			s.logger.Infof("redirecting, could not find sessionid cookie")
-			w.Header().Set("Location", "/login")
-			w.WriteHeader(http.StatusSeeOther)
-			return
-		}
+		usess := auth.CurrentSession(r)
 
 		response := HttpResponse{}
 
 		switch r.Method {
 		case "GET":
-			response = s.ShowAddPhotoForm(cookie.Value)
+			response = s.ShowDeletePostForm(
+				usess,
+				r.URL.Query().Get("url"),
+			)
 		case "POST":
-			err := r.ParseMultipartForm(32 << 20)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+			response = s.DeletePost(
+				usess,
+				r.FormValue("url"),
+			)
+		}
 
-			photoFiles := []UploadedFile{}
-			for _, photoFile := range r.MultipartForm.File["photo"] {
-				file, err := photoFile.Open()
-				if err != nil {
-					s.logger.WithError(err).Error("failed to open file")
-					continue
-				}
-				photoFiles = append(photoFiles, UploadedFile{Filename: photoFile.Filename, File: file})
-			}
-			response = s.AddPhotos(cookie.Value, photoFiles)
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
 		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+func (s *server) HandleDeletedPosts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
+		usess := auth.CurrentSession(r)
+
+		response := s.ShowDeletedPosts(usess)
 		for k, v := range response.Headers {
 			w.Header().Set(k, v)
 		}
@@ -409,57 +507,1172 @@ func (s *server) HandleAddPhotoForm() http.HandlerFunc {
 	}
 }
 
-func (s *server) HandleAddLocationForm() http.HandlerFunc {
+func (s *server) HandleUndeletePost() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		cookie, err := r.Cookie("sessionid")
-		if err != nil {
-			s.logger.Infof("redirecting, could not find sessionid cookie")
-			w.Header().Set("Location", "/login")
-			w.WriteHeader(http.StatusSeeOther)
-			return
+		usess := auth.CurrentSession(r)
+
+		response := s.UndeletePost(usess, r.FormValue("url"))
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+func (s *server) ShowDeletePostForm(usess session.UserSession, postURL string) HttpResponse {
+
+	// fetch post
+	post, err := s.client.QuerySource(usess.MicropubEndpoint, usess.AccessToken, postURL)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to query post source")
+		return HttpResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       err.Error(),
+		}
+	}
+	if len(post.Type) == 0 {
+		post.Type = []string{"h-entry"}
+	}
+
+	// render
+	t, err := template.ParseFiles(
+		"view/components.html",
+		"view/layout.html",
+		"view/deletepost.html",
+	)
+	if err != nil {
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+
+	w := new(bytes.Buffer)
+	v := struct {
+		PageTitle string
+		CSRFToken string
+		URL       string
+		Post      mf2.MicroFormatView
+		Accounts  session.Accounts
+	}{
+		PageTitle: "Delete Post",
+		CSRFToken: usess.CSRFToken,
+		URL:       postURL,
+		Post:      post.ToView(),
+		Accounts:  usess.Accounts(),
+	}
+	t.ExecuteTemplate(w, "layout", v)
+
+	headers := map[string]string{
+		"Content-Type": "text/html; charset=UTF-8",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusOK,
+		Body:       w.String(),
+		Headers:    headers,
+	}
+}
+
+func (s *server) DeletePost(usess session.UserSession, postURL string) HttpResponse {
+
+	// keep a summary of the post so it can be recognised in the
+	// recently deleted list
+	summary := ""
+	post, err := s.client.QuerySource(usess.MicropubEndpoint, usess.AccessToken, postURL)
+	if err != nil {
+		s.logger.WithError(err).Info("failed to query post source")
+	} else {
+		summary = post.GetFirstString("name")
+		if summary == "" {
+			summary = post.GetFirstString("content")
+		}
+	}
+
+	mpResponse, err := s.client.Delete(postURL, usess.MicropubEndpoint, usess.AccessToken)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to send MP delete request")
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+	if !mpResponse.IsSuccess() {
+		return HttpResponse{
+			StatusCode: http.StatusBadGateway,
+			Body:       mpResponse.ErrorMessage(),
+		}
+	}
+
+	err = deleted.Add(s.deleted, deleted.Post{
+		Me:        usess.Me,
+		URL:       postURL,
+		Summary:   summary,
+		DeletedAt: time.Now(),
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("failed to save deleted post")
+	}
+
+	headers := map[string]string{
+		"Location": "/queryposts",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusSeeOther,
+		Headers:    headers,
+	}
+}
+
+func (s *server) ShowDeletedPosts(usess session.UserSession) HttpResponse {
+
+	posts, err := deleted.Recent(s.deleted, usess.Me)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to list deleted posts")
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+
+	// render
+	t, err := template.ParseFiles(
+		"view/components.html",
+		"view/layout.html",
+		"view/deletedposts.html",
+	)
+	if err != nil {
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+
+	w := new(bytes.Buffer)
+	v := struct {
+		PageTitle    string
+		CSRFToken    string
+		DeletedPosts []deleted.Post
+		Can          session.Permissions
+		Accounts     session.Accounts
+	}{
+		PageTitle:    "Recently Deleted",
+		CSRFToken:    usess.CSRFToken,
+		DeletedPosts: posts,
+		Can:          usess.Permissions(),
+		Accounts:     usess.Accounts(),
+	}
+	t.ExecuteTemplate(w, "layout", v)
+
+	headers := map[string]string{
+		"Content-Type": "text/html; charset=UTF-8",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusOK,
+		Body:       w.String(),
+		Headers:    headers,
+	}
+}
+
+func (s *server) UndeletePost(usess session.UserSession, postURL string) HttpResponse {
+
+	mpResponse, err := s.client.Undelete(postURL, usess.MicropubEndpoint, usess.AccessToken)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to send MP undelete request")
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+	if !mpResponse.IsSuccess() {
+		return HttpResponse{
+			StatusCode: http.StatusBadGateway,
+			Body:       mpResponse.ErrorMessage(),
 		}
+	}
+
+	err = s.deleted.Delete(usess.Me, postURL)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to remove deleted post")
+	}
+
+	headers := map[string]string{
+		"Location": "/deleted",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusSeeOther,
+		Headers:    headers,
+	}
+}
+
+func (s *server) HandleOutbox() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usess := auth.CurrentSession(r)
+
+		response := s.ShowOutbox(usess)
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+func (s *server) HandleEditOutboxItemForm() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usess := auth.CurrentSession(r)
+
+		response := HttpResponse{}
+
+		switch r.Method {
+		case "GET":
+			response = s.ShowEditOutboxItemForm(
+				usess,
+				r.URL.Query().Get("id"),
+			)
+		case "POST":
+			response = s.UpdateOutboxItem(
+				usess,
+				r.FormValue("id"),
+				r.FormValue("content"),
+				r.FormValue("published"),
+				r.FormValue("tz-offset"),
+			)
+		}
+
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+func (s *server) HandleRetryOutboxItem() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usess := auth.CurrentSession(r)
+
+		response := s.RetryOutboxItem(usess, r.FormValue("id"))
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+func (s *server) HandleDiscardOutboxItem() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usess := auth.CurrentSession(r)
+
+		response := s.DiscardOutboxItem(usess, r.FormValue("id"))
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+// schedulePost holds post in the outbox until publishAt
+func (s *server) schedulePost(usess session.UserSession, post mf2.MicroFormat, publishAt time.Time) HttpResponse {
+
+	item := outbox.NewItem(usess.Uid, usess.Me, post, publishAt, time.Now())
+	err := s.outbox.Save(item)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to save scheduled post")
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+	s.logger.
+		WithField("id", item.ID).
+		WithField("send_at", item.SendAt).
+		Info("post scheduled")
+
+	usess.ClearComposerData()
+	err = s.SessionStore.Create(usess)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to save session")
+	}
+
+	headers := map[string]string{
+		"Location": "/outbox",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusSeeOther,
+		Headers:    headers,
+	}
+}
+
+// queuePost saves a post that could not be sent to the outbox so it can
+// be retried
+func (s *server) queuePost(usess session.UserSession, post mf2.MicroFormat, sendErr error) HttpResponse {
+
+	item := outbox.NewPendingItem(usess.Uid, usess.Me, post, sendErr, time.Now())
+	err := s.outbox.Save(item)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to save post to outbox")
+		return s.redirectToComposerWithFlash(usess, "Failed to send post: "+sendErr.Error())
+	}
+	s.logger.
+		WithField("id", item.ID).
+		WithField("send_at", item.SendAt).
+		Info("post saved to outbox")
+
+	// the post is safe in the outbox so the composer can be cleared
+	usess.ClearComposerData()
+	return s.redirectToComposerWithFlash(
+		usess,
+		"Could not reach your micropub endpoint, the post was saved to the outbox and will be retried",
+	)
+}
+
+// SendOutboxItem sends a post from the outbox to the micropub endpoint
+// of the site that created it
+func (s *server) SendOutboxItem(item outbox.Item) error {
+
+	usess, err := s.outboxSession(item)
+	if err != nil {
+		return err
+	}
+	usess, err = s.tokens.RefreshIfNeeded(usess, time.Now())
+	if err == session.ErrTokenRevoked {
+		// retrying will not help until the user logs in again
+		return outbox.PermanentError{Err: err}
+	}
+	if err != nil {
+		return err
+	}
+
+	var mpResponse MicropubEndpointResponse
+	if item.Post.IsFlat() {
+		mpResponse, err = s.client.SendRequest(item.Post.ToForm(), usess.MicropubEndpoint, usess.AccessToken)
+	} else {
+		mpResponse, err = s.client.SendJSONRequest(item.Post, usess.MicropubEndpoint, usess.AccessToken)
+	}
+	if err != nil {
+		return err
+	}
+	if !mpResponse.IsSuccess() {
+		err = errors.New(mpResponse.ErrorMessage())
+		// the endpoint rejected the post, only server errors are retried
+		if mpResponse.StatusCode < 500 {
+			return outbox.PermanentError{Err: err}
+		}
+		return err
+	}
+	s.logger.WithField("location", mpResponse.Location).Info("post created")
+	return nil
+}
+
+// outboxSession fetches the session that created item, posts are only
+// sent with the token of the session that owns them
+func (s *server) outboxSession(item outbox.Item) (session.UserSession, error) {
+	usess, err := s.SessionStore.FetchByID(item.SessionID)
+	if err == nil && usess.Me == item.Me && usess.AccessToken != "" {
+		return usess, nil
+	}
+	// retrying will not help until the user logs in again
+	return session.UserSession{}, outbox.PermanentError{
+		Err: fmt.Errorf("the session for %s has ended, log in and retry the post", item.Me),
+	}
+}
+
+func (s *server) ShowOutbox(usess session.UserSession) HttpResponse {
+
+	items, err := outbox.ListForUser(s.outbox, usess.Me)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to list outbox")
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+
+	// render
+	t, err := template.ParseFiles(
+		"view/components.html",
+		"view/layout.html",
+		"view/outbox.html",
+	)
+	if err != nil {
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+
+	w := new(bytes.Buffer)
+	v := struct {
+		PageTitle string
+		CSRFToken string
+		Items     []outbox.Item
+		Accounts  session.Accounts
+	}{
+		PageTitle: "Outbox",
+		CSRFToken: usess.CSRFToken,
+		Items:     items,
+		Accounts:  usess.Accounts(),
+	}
+	t.ExecuteTemplate(w, "layout", v)
+
+	headers := map[string]string{
+		"Content-Type": "text/html; charset=UTF-8",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusOK,
+		Body:       w.String(),
+		Headers:    headers,
+	}
+}
+
+// fetchOutboxItem fetches an outbox item, only returning items that
+// belong to usess
+func (s *server) fetchOutboxItem(usess session.UserSession, id string) (outbox.Item, error) {
+	item, err := s.outbox.FetchByID(id)
+	if err != nil {
+		return item, err
+	}
+	if item.Me != usess.Me {
+		return outbox.Item{}, fmt.Errorf("outbox item %s not found", id)
+	}
+	return item, nil
+}
+
+func (s *server) ShowEditOutboxItemForm(usess session.UserSession, id string) HttpResponse {
+
+	item, err := s.fetchOutboxItem(usess, id)
+	if err != nil {
+		s.logger.WithError(err).Info("failed to fetch outbox item")
+		return HttpResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       err.Error(),
+		}
+	}
+
+	// render
+	t, err := template.ParseFiles(
+		"view/components.html",
+		"view/layout.html",
+		"view/editoutboxitem.html",
+	)
+	if err != nil {
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+
+	w := new(bytes.Buffer)
+	published := ""
+	if item.Status == outbox.StatusScheduled {
+		published = item.SendAt.Format(publishedInputLayout)
+	}
+	v := struct {
+		PageTitle string
+		CSRFToken string
+		Item      outbox.Item
+		Published string
+		Accounts  session.Accounts
+	}{
+		PageTitle: "Edit Post",
+		CSRFToken: usess.CSRFToken,
+		Item:      item,
+		Published: published,
+		Accounts:  usess.Accounts(),
+	}
+	t.ExecuteTemplate(w, "layout", v)
+
+	headers := map[string]string{
+		"Content-Type": "text/html; charset=UTF-8",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusOK,
+		Body:       w.String(),
+		Headers:    headers,
+	}
+}
+
+func (s *server) UpdateOutboxItem(usess session.UserSession, id, content, published, tzOffset string) HttpResponse {
+
+	item, err := s.fetchOutboxItem(usess, id)
+	if err != nil {
+		s.logger.WithError(err).Info("failed to fetch outbox item")
+		return HttpResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       err.Error(),
+		}
+	}
+
+	// without a publish time the post is sent again straight away
+	var publishAt time.Time
+	if strings.TrimSpace(published) != "" {
+		publishAt, err = time.ParseInLocation(publishedInputLayout, published, publishedLocation(tzOffset))
+		if err != nil {
+			return HttpResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "published must be a valid date and time",
+			}
+		}
+	}
+
+	now := time.Now()
+	_, err = s.outbox.Update(item.ID, func(item *outbox.Item) error {
+		if item.Sending(now) {
+			return outbox.ErrSending
+		}
+		// send with the current session so a fresh access token is used
+		item.SessionID = usess.Uid
+		item.SetContent(content)
+		if publishAt.IsZero() {
+			item.Retry(now)
+		} else {
+			item.Reschedule(publishAt)
+		}
+		return nil
+	})
+	if err == outbox.ErrSending {
+		return outboxItemSending()
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("failed to save outbox item")
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+
+	headers := map[string]string{
+		"Location": "/outbox",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusSeeOther,
+		Headers:    headers,
+	}
+}
+
+func (s *server) RetryOutboxItem(usess session.UserSession, id string) HttpResponse {
+
+	item, err := s.fetchOutboxItem(usess, id)
+	if err != nil {
+		s.logger.WithError(err).Info("failed to fetch outbox item")
+		return HttpResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       err.Error(),
+		}
+	}
+
+	// claim the item so the worker does not send it at the same time
+	now := time.Now()
+	item, err = s.outbox.Update(item.ID, func(item *outbox.Item) error {
+		if item.Sending(now) {
+			return outbox.ErrSending
+		}
+		// send with the current session so a fresh access token is used
+		item.SessionID = usess.Uid
+		item.Retry(now)
+		return item.Claim(now)
+	})
+	if err == outbox.ErrSending {
+		return outboxItemSending()
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("failed to update outbox")
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+	outbox.Send(s.outbox, s.SendOutboxItem, item, now, s.logger)
+
+	headers := map[string]string{
+		"Location": "/outbox",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusSeeOther,
+		Headers:    headers,
+	}
+}
+
+func (s *server) DiscardOutboxItem(usess session.UserSession, id string) HttpResponse {
+
+	item, err := s.fetchOutboxItem(usess, id)
+	if err != nil {
+		s.logger.WithError(err).Info("failed to fetch outbox item")
+		return HttpResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       err.Error(),
+		}
+	}
+
+	// fail the item first so the worker can not claim it while it is
+	// deleted
+	now := time.Now()
+	_, err = s.outbox.Update(item.ID, func(item *outbox.Item) error {
+		if item.Sending(now) {
+			return outbox.ErrSending
+		}
+		item.Status = outbox.StatusFailed
+		return nil
+	})
+	if err == outbox.ErrSending {
+		return outboxItemSending()
+	}
+	if err == nil {
+		err = s.outbox.Delete(item.ID)
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("failed to discard outbox item")
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+
+	headers := map[string]string{
+		"Location": "/outbox",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusSeeOther,
+		Headers:    headers,
+	}
+}
+
+// outboxItemSending is the response to changing an item while it is
+// being sent
+func outboxItemSending() HttpResponse {
+	return HttpResponse{
+		StatusCode: http.StatusConflict,
+		Body:       "the post is being sent, check the outbox again in a moment",
+	}
+}
+
+// splitFields splits s on sep, trimming whitespace and dropping empty
+// values
+func splitFields(s, sep string) []string {
+	var out []string
+	for _, v := range strings.Split(s, sep) {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (s *server) HandleSubmit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usess := auth.CurrentSession(r)
+
+		err := r.ParseForm()
+		if err != nil {
+			s.logger.WithError(err).Error("failed to parse form")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		response := s.SubmitPost(usess, r.PostForm)
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+func (s *server) SubmitPost(usess session.UserSession, form url.Values) HttpResponse {
+
+	// update composer from form and keep it in case of errors
+	usess.ComposerData = parseComposerForm(usess.ComposerData, form)
+	err := s.SessionStore.Create(usess)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to save session")
+	}
+
+	err = usess.ComposerData.Validate()
+	if err != nil {
+		s.logger.WithError(err).Info("invalid post")
+		return s.renderComposerForm(usess, err.Error(), http.StatusBadRequest)
+	}
+
+	// build POST body
+	post := buildPost(usess.ComposerData, form.Get("h"))
+	s.logger.WithFields(logrus.Fields{"request": post}).Info("built micropub request")
+
+	// posts published in the future are held in the outbox until then
+	publishAt, err := usess.ComposerData.PublishedTime()
+	if err == nil && publishAt.After(time.Now()) && usess.ComposerData.PostStatus != session.PostStatusDraft {
+		return s.schedulePost(usess, post, publishAt)
+	}
+
+	var mpResponse MicropubEndpointResponse
+	if post.IsFlat() {
+		mpResponse, err = s.client.SendRequest(post.ToForm(), usess.MicropubEndpoint, usess.AccessToken)
+	} else {
+		mpResponse, err = s.client.SendJSONRequest(post, usess.MicropubEndpoint, usess.AccessToken)
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("failed to send MP request")
+		return s.queuePost(usess, post, err)
+	}
+	if !mpResponse.IsSuccess() {
+		s.logger.
+			WithField("status", mpResponse.StatusCode).
+			WithField("error", mpResponse.Error).
+			WithField("error_description", mpResponse.ErrorDescription).
+			Info("micropub endpoint rejected post")
+		return s.redirectToComposerWithFlash(usess, "Post was not created, "+mpResponse.ErrorMessage())
+	}
+	s.logger.WithField("location", mpResponse.Location).Info("post created")
+
+	usess.ClearComposerData()
+	err = s.SessionStore.Create(usess)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to save session")
+	}
+
+	// redirect
+	headers := map[string]string{
+		"Location": "/composer",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusSeeOther,
+		Headers:    headers,
+	}
+}
+
+// redirectToComposerWithFlash keeps the composer data and shows message
+// the next time the composer is rendered
+func (s *server) redirectToComposerWithFlash(usess session.UserSession, message string) HttpResponse {
+	usess.Flash = message
+	err := s.SessionStore.Create(usess)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to save session")
+	}
+
+	headers := map[string]string{
+		"Location": "/composer",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusSeeOther,
+		Headers:    headers,
+	}
+}
+
+// parseComposerForm copies the fields submitted from the composer form
+// into the composer data
+func parseComposerForm(cd session.ComposerData, form url.Values) session.ComposerData {
+	if _, ok := form["post-type"]; ok {
+		cd.PostType = form.Get("post-type")
+	}
+	cd.Content = form.Get("content")
+	cd.Name = strings.TrimSpace(form.Get("name"))
+	cd.ContentFormat = form.Get("content-format")
+	cd.InReplyTo = strings.TrimSpace(form.Get("in-reply-to"))
+	cd.LikeOf = strings.TrimSpace(form.Get("like-of"))
+	cd.BookmarkOf = strings.TrimSpace(form.Get("bookmark-of"))
+	cd.RepostOf = strings.TrimSpace(form.Get("repost-of"))
+	cd.Rsvp = strings.ToLower(strings.TrimSpace(form.Get("rsvp")))
+	cd.SyndicateTo = form["mp-syndicate-to"]
+	cd.PostStatus = form.Get("post-status")
+	if published, ok := form["published"]; ok {
+		cd.Published = parsePublishedInput(published[0], form.Get("tz-offset"))
+	}
+	for i, alt := range form["photo-alt"] {
+		if i < len(cd.Photos) {
+			cd.Photos[i].Alt = strings.TrimSpace(alt)
+		}
+	}
+	return cd
+}
+
+// publishedInputLayout is the format of a datetime-local input
+const publishedInputLayout = "2006-01-02T15:04"
+
+// maxTZOffset is the furthest any time zone is from UTC, in minutes
+const maxTZOffset = 14 * 60
+
+// publishedLocation is the time zone of the browser that filled in a
+// datetime-local input, tzOffset is its utc offset in minutes. Without
+// one the time zone of the server is used
+func publishedLocation(tzOffset string) *time.Location {
+	minutes, err := strconv.Atoi(strings.TrimSpace(tzOffset))
+	if err != nil || minutes < -maxTZOffset || minutes > maxTZOffset {
+		return time.Local
+	}
+	return time.FixedZone("", minutes*60)
+}
+
+// parsePublishedInput converts the value of the published datetime-local
+// input, filled in at tzOffset, to RFC3339
+func parsePublishedInput(value, tzOffset string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	published, err := time.ParseInLocation(publishedInputLayout, value, publishedLocation(tzOffset))
+	if err != nil {
+		return value
+	}
+	return published.Format(time.RFC3339)
+}
+
+// formatPublishedInput formats an RFC3339 published date for a
+// datetime-local input, in the time zone it was entered in
+func formatPublishedInput(cd session.ComposerData) string {
+	published, err := cd.PublishedTime()
+	if err != nil {
+		return ""
+	}
+	return published.Format(publishedInputLayout)
+}
+
+// buildPost builds the micropub create request for the composer post
+// type
+func buildPost(cd session.ComposerData, h string) mf2.MicroFormat {
+	if h == "" {
+		h = "entry"
+	}
+	post := mf2.MicroFormat{
+		Type:       []string{"h-" + h},
+		Properties: make(map[string][]interface{}),
+	}
+
+	addContent := func() {
+		if strings.TrimSpace(cd.Content) == "" {
+			return
+		}
+		if cd.ContentFormat == session.ContentFormatHTML {
+			post.AddProperty("content", map[string]interface{}{"html": cd.Content})
+			return
+		}
+		// endpoints show plain content as it is, so markdown is sent as
+		// the html it renders to
+		if cd.ContentFormat == session.ContentFormatMarkdown {
+			html := blackfriday.MarkdownCommon([]byte(cd.Content))
+			post.AddProperty("content", map[string]interface{}{"html": string(html)})
+			return
+		}
+		post.AddProperty("content", cd.Content)
+	}
+	addPhotos := func() {
+		for _, photo := range cd.Photos {
+			if photo.Alt == "" {
+				post.AddProperty("photo", photo.URL)
+				continue
+			}
+			post.AddProperty("photo", map[string]interface{}{
+				"value": photo.URL,
+				"alt":   photo.Alt,
+			})
+		}
+	}
+
+	switch cd.Type() {
+	case session.PostTypeNote, session.PostTypeCheckin:
+		addContent()
+		addPhotos()
+	case session.PostTypeArticle:
+		post.AddProperty("name", cd.Name)
+		addContent()
+		addPhotos()
+	case session.PostTypeReply:
+		post.AddProperty("in-reply-to", cd.InReplyTo)
+		addContent()
+		addPhotos()
+	case session.PostTypeLike:
+		post.AddProperty("like-of", cd.LikeOf)
+	case session.PostTypeBookmark:
+		post.AddProperty("bookmark-of", cd.BookmarkOf)
+		if cd.Name != "" {
+			post.AddProperty("name", cd.Name)
+		}
+		addContent()
+	case session.PostTypeRepost:
+		post.AddProperty("repost-of", cd.RepostOf)
+		addContent()
+	case session.PostTypeRsvp:
+		post.AddProperty("in-reply-to", cd.InReplyTo)
+		post.AddProperty("rsvp", cd.Rsvp)
+		addContent()
+	}
+
+	for _, category := range cd.Category {
+		post.AddProperty("category", category)
+	}
+	for _, target := range cd.SyndicateTo {
+		post.AddProperty("mp-syndicate-to", target)
+	}
+	if cd.PostStatus == session.PostStatusDraft {
+		post.AddProperty("post-status", session.PostStatusDraft)
+	}
+
+	published := time.Now().Format(time.RFC3339)
+	if cd.Published != "" {
+		published = cd.Published
+	}
+	post.AddProperty("published", published)
+
+	if cd.Location.HasLatLng() {
+		switch {
+		case cd.Type() == session.PostTypeCheckin:
+			post.AddProperty("checkin", buildLocationCard(cd.Location, "h-card"))
+		case cd.Location.HasAddress():
+			post.AddProperty("location", buildLocationCard(cd.Location, "h-adr"))
+		default:
+			post.AddProperty("location", cd.Location.ToGeoURL())
+		}
+	}
+
+	return post
+}
+
+// buildLocationCard builds a nested h-card or h-adr for loc
+func buildLocationCard(loc session.Location, h string) map[string]interface{} {
+	properties := map[string][]interface{}{
+		"latitude":  []interface{}{loc.Lat},
+		"longitude": []interface{}{loc.Lng},
+	}
+	if h == "h-card" && loc.Locality != "" {
+		properties["name"] = []interface{}{loc.Locality}
+	}
+	if loc.Locality != "" {
+		properties["locality"] = []interface{}{loc.Locality}
+	}
+	if loc.Region != "" {
+		properties["region"] = []interface{}{loc.Region}
+	}
+	if loc.Country != "" {
+		properties["country-name"] = []interface{}{loc.Country}
+	}
+	return map[string]interface{}{
+		"type":       []string{h},
+		"properties": properties,
+	}
+}
+
+func (s *server) HandleAddPhotoForm() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usess := auth.CurrentSession(r)
+
+		response := HttpResponse{}
+
+		switch r.Method {
+		case "GET":
+			response = s.ShowAddPhotoForm(usess)
+		case "POST":
+			err := r.ParseMultipartForm(32 << 20)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			photoFiles := []UploadedFile{}
+			for _, photoFile := range r.MultipartForm.File["photo"] {
+				file, err := photoFile.Open()
+				if err != nil {
+					s.logger.WithError(err).Error("failed to open file")
+					continue
+				}
+				photoFiles = append(photoFiles, UploadedFile{Filename: photoFile.Filename, File: file})
+			}
+			response = s.AddPhotos(usess, photoFiles)
+		}
+
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+func (s *server) HandleAddLocationForm() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usess := auth.CurrentSession(r)
+
+		s.logger.Infof("%s", r.RemoteAddr)
+
+		response := HttpResponse{}
+
+		switch r.Method {
+		case "GET":
+			response = s.ShowAddLocationForm(
+				usess,
+				r.URL.Query().Get("q"),
+			)
+		case "POST":
+			response = s.AddLocation(
+				usess,
+				r.FormValue("locality"),
+				r.FormValue("region"),
+				r.FormValue("country"),
+				r.FormValue("lat"),
+				r.FormValue("lng"),
+			)
+		}
+
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+func (s *server) HandleAddCategoryForm() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usess := auth.CurrentSession(r)
+
+		response := HttpResponse{}
+
+		switch r.Method {
+		case "GET":
+			response = s.ShowAddCategoryForm(
+				usess,
+				r.URL.Query().Get("q"),
+			)
+		case "POST":
+			response = s.AddCategory(
+				usess,
+				r.FormValue("category"),
+			)
+		}
+
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+func (s *server) HandleRemoveCategory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usess := auth.CurrentSession(r)
+
+		response := s.RemoveCategory(usess, r.FormValue("category"))
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
+
+func (s *server) ShowAddCategoryForm(usess session.UserSession, categoryQuery string) HttpResponse {
+
+	// refresh cached categories
+	now := time.Now()
+	if usess.CategoriesExpired(now) {
+		categories, err := s.client.QueryCategories(usess.MicropubEndpoint, usess.AccessToken)
+		if err != nil {
+			s.logger.WithError(err).Error("failed to query categories")
+		} else {
+			usess.SetCategories(categories, now)
+			err = s.SessionStore.Create(usess)
+			if err != nil {
+				s.logger.WithError(err).Error("failed to save session")
+			}
+		}
+	}
+
+	// render
+	t, err := template.ParseFiles(
+		"view/components.html",
+		"view/layout.html",
+		"view/addcategory.html",
+	)
+	if err != nil {
+		return HttpResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       err.Error(),
+		}
+	}
+
+	w := new(bytes.Buffer)
+	v := struct {
+		PageTitle   string
+		CSRFToken   string
+		Query       string
+		Suggestions []string
+		Categories  []string
+		Accounts    session.Accounts
+	}{
+		PageTitle:   "Add Tag",
+		CSRFToken:   usess.CSRFToken,
+		Query:       categoryQuery,
+		Suggestions: usess.SuggestCategories(categoryQuery, 20),
+		Categories:  usess.Categories,
+		Accounts:    usess.Accounts(),
+	}
+	t.ExecuteTemplate(w, "layout", v)
+
+	headers := map[string]string{
+		"Content-Type": "text/html; charset=UTF-8",
+	}
+
+	return HttpResponse{
+		StatusCode: http.StatusOK,
+		Body:       w.String(),
+		Headers:    headers,
+	}
+}
 
-		s.logger.Infof("%s", r.RemoteAddr)
+func (s *server) AddCategory(usess session.UserSession, category string) HttpResponse {
 
-		response := HttpResponse{}
+	for _, c := range splitFields(category, ",") {
+		usess.AddCategory(c)
+	}
 
-		switch r.Method {
-		case "GET":
-			response = s.ShowAddLocationForm(
-				cookie.Value,
-				r.URL.Query().Get("q"),
-			)
-		case "POST":
-			response = s.AddLocation(
-				cookie.Value,
-				r.FormValue("locality"),
-				r.FormValue("region"),
-				r.FormValue("country"),
-				r.FormValue("lat"),
-				r.FormValue("lng"),
-			)
-		}
+	err := s.SessionStore.Create(usess)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to save session")
+		return HttpResponse{StatusCode: http.StatusInternalServerError}
+	}
 
-		for k, v := range response.Headers {
-			w.Header().Set(k, v)
-		}
-		w.WriteHeader(response.StatusCode)
-		w.Write([]byte(response.Body))
+	// redirect
+	headers := map[string]string{
+		"Location": "/composer",
+	}
+	return HttpResponse{
+		StatusCode: http.StatusSeeOther,
+		Headers:    headers,
 	}
 }
 
-func (s server) AddLocation(sessionid, locality, region, country, lat, lng string) HttpResponse {
+func (s *server) RemoveCategory(usess session.UserSession, category string) HttpResponse {
+
+	usess.RemoveCategory(category)
 
-	// checkSession
-	usess, err := s.SessionStore.FetchByID(sessionid)
+	err := s.SessionStore.Create(usess)
 	if err != nil {
-		return HttpResponse{
-			StatusCode: http.StatusInternalServerError,
-		}
+		s.logger.WithError(err).Error("failed to save session")
+		return HttpResponse{StatusCode: http.StatusInternalServerError}
+	}
+
+	// redirect
+	headers := map[string]string{
+		"Location": "/composer",
 	}
-	s.logger.WithField("user", usess).
-		Info("logged in user")
+	return HttpResponse{
+		StatusCode: http.StatusSeeOther,
+		Headers:    headers,
+	}
+}
+
+func (s server) AddLocation(usess session.UserSession, locality, region, country, lat, lng string) HttpResponse {
 
 	location := session.Location{
 		Locality: locality,
@@ -470,7 +1683,7 @@ func (s server) AddLocation(sessionid, locality, region, country, lat, lng strin
 	}
 	usess.AddLocation(location)
 
-	err = s.SessionStore.Create(usess)
+	err := s.SessionStore.Create(usess)
 	if err != nil {
 		s.logger.WithError(err).Error("failed to save session")
 		return HttpResponse{StatusCode: http.StatusInternalServerError}
@@ -540,17 +1753,7 @@ type MediaEndpointResponse struct {
 	Published string `json:"published"`
 }
 
-func (s *server) AddPhotos(sessionid string, fileList []UploadedFile) HttpResponse {
-
-	// checkSession
-	usess, err := s.SessionStore.FetchByID(sessionid)
-	if err != nil {
-		return HttpResponse{
-			StatusCode: http.StatusInternalServerError,
-		}
-	}
-	s.logger.WithField("user", usess).
-		Info("logged in user")
+func (s *server) AddPhotos(usess session.UserSession, fileList []UploadedFile) HttpResponse {
 
 	// upload photos to media endpoint
 	s.logger.WithField("media_endpoint", usess.MediaEndpoint).
@@ -670,22 +1873,72 @@ func (client Client) UploadToMediaServer(uploadedFile UploadedFile, usess sessio
 }
 
 type MicropubEndpointResponse struct {
-	StatusCode int
-	Location   string
+	StatusCode       int
+	Location         string
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// IsSuccess is true when the endpoint accepted the request
+func (r MicropubEndpointResponse) IsSuccess() bool {
+	return r.StatusCode >= 200 && r.StatusCode <= 299
+}
+
+// micropubErrors explains the error codes defined by the micropub spec
+var micropubErrors = map[string]string{
+	"forbidden":          "you are not allowed to do this",
+	"unauthorized":       "you need to log in again",
+	"insufficient_scope": "your access token does not have the required scope",
+	"invalid_request":    "the request was invalid",
+}
+
+// ErrorMessage explains why the endpoint rejected a request
+func (r MicropubEndpointResponse) ErrorMessage() string {
+	msg := fmt.Sprintf("micropub endpoint returned %d", r.StatusCode)
+	if r.Error != "" {
+		msg = fmt.Sprintf("%s %s", msg, r.Error)
+		if explanation, ok := micropubErrors[r.Error]; ok {
+			msg = fmt.Sprintf("%s, %s", msg, explanation)
+		}
+	}
+	if r.ErrorDescription != "" {
+		msg = fmt.Sprintf("%s: %s", msg, r.ErrorDescription)
+	}
+	return msg
+}
+
+// maxErrorBodySize is how much of an error response body is read
+const maxErrorBodySize = 64 * 1024
+
+// newMicropubEndpointResponse reads the response of the micropub endpoint,
+// parsing the error body of unsuccessful requests
+func newMicropubEndpointResponse(resp *http.Response) MicropubEndpointResponse {
+	mpResponse := MicropubEndpointResponse{
+		StatusCode: resp.StatusCode,
+		Location:   resp.Header.Get("location"),
+	}
+	if mpResponse.IsSuccess() {
+		return mpResponse
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if err != nil {
+		return mpResponse
+	}
+	err = json.Unmarshal(body, &mpResponse)
+	if err != nil {
+		// not an OAuth style error, use the body as the description
+		mpResponse.ErrorDescription = strings.TrimSpace(string(body))
+	}
+	return mpResponse
 }
 
 func (s *server) HandleComposerForm() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		cookie, err := r.Cookie("sessionid")
-		if err != nil {
-			s.logger.Infof("redirecting, could not find sessionid cookie")
-			w.Header().Set("Location", "/login")
-			w.WriteHeader(http.StatusSeeOther)
-			return
-		}
+		usess := auth.CurrentSession(r)
 
-		response := s.ShowComposerForm(cookie.Value)
+		response := s.ShowComposerForm(usess, r.URL.Query().Get("type"))
 		for k, v := range response.Headers {
 			w.Header().Set(k, v)
 		}
@@ -694,17 +1947,103 @@ func (s *server) HandleComposerForm() http.HandlerFunc {
 	}
 }
 
-func (s *server) ShowComposerForm(sessionid string) HttpResponse {
+func (s *server) HandleRefreshProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		usess := auth.CurrentSession(r)
+
+		response := s.RefreshProfile(usess)
+		for k, v := range response.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write([]byte(response.Body))
+	}
+}
 
-	// fetch session
-	usess, err := s.SessionStore.FetchByID(sessionid)
+// RefreshProfile fetches the h-card of the profile page again, for when
+// the name or photo was changed
+func (s *server) RefreshProfile(usess session.UserSession) HttpResponse {
+	err := usess.RefreshHCard(time.Now())
 	if err != nil {
-		return HttpResponse{
-			StatusCode: http.StatusInternalServerError,
-			Body:       err.Error(),
+		s.logger.WithError(err).Error("failed to refresh h-card")
+		return s.redirectToComposerWithFlash(usess, "Failed to refresh your profile, "+err.Error())
+	}
+	return s.redirectToComposerWithFlash(usess, "")
+}
+
+func (s *server) ShowComposerForm(usess session.UserSession, postType string) HttpResponse {
+
+	// switch post type
+	saveSession := false
+	if postType != "" && postType != usess.ComposerData.Type() {
+		usess.SetPostType(postType)
+		saveSession = true
+	}
+
+	// syndication targets are only queried if they were not in the
+	// micropub config
+	if usess.SyndicateTo == nil {
+		targets, err := s.client.QuerySyndicateTo(usess.MicropubEndpoint, usess.AccessToken)
+		if err != nil {
+			s.logger.WithError(err).Error("failed to query syndication targets")
+		} else {
+			usess.SyndicateTo = append([]session.SyndicationTarget{}, targets...)
+			saveSession = true
+		}
+	}
+
+	// the cached h-card is fetched again once it is a day old
+	if usess.HCardExpired(time.Now()) {
+		err := usess.RefreshHCard(time.Now())
+		if err != nil {
+			s.logger.WithError(err).Error("failed to refresh h-card")
+		} else {
+			saveSession = true
 		}
 	}
-	s.logger.WithFields(logrus.Fields{"user": usess}).Info("logged in user")
+
+	// flash messages are only shown once
+	flash := usess.PopFlash()
+	if flash != "" {
+		saveSession = true
+	}
+
+	if saveSession {
+		err := s.SessionStore.Create(usess)
+		if err != nil {
+			s.logger.WithError(err).Error("failed to save session")
+		}
+	}
+
+	return s.renderComposerForm(usess, flash, http.StatusOK)
+}
+
+type syndicationOption struct {
+	UID     string
+	Name    string
+	Checked bool
+}
+
+func syndicationOptions(targets []session.SyndicationTarget, selected []string) []syndicationOption {
+	out := []syndicationOption{}
+	for _, target := range targets {
+		checked := false
+		for _, uid := range selected {
+			if uid == target.UID {
+				checked = true
+			}
+		}
+		out = append(out, syndicationOption{
+			UID:     target.UID,
+			Name:    target.Name,
+			Checked: checked,
+		})
+	}
+	return out
+}
+
+func (s *server) renderComposerForm(usess session.UserSession, errorMessage string, statusCode int) HttpResponse {
 
 	// render
 	t, err := template.ParseFiles(
@@ -722,17 +2061,37 @@ func (s *server) ShowComposerForm(sessionid string) HttpResponse {
 
 	w := new(bytes.Buffer)
 	v := struct {
-		PageTitle string
-		Photos    []session.MediaUpload
-		User      session.HCard
-		Published string
-		Location  string
+		PageTitle      string
+		CSRFToken      string
+		Photos         []session.MediaUpload
+		Accounts       session.Accounts
+		Published      string
+		PublishedInput string
+		Location       string
+		Category       []string
+		Syndicate      []syndicationOption
+		PostType       string
+		PostTypes      []string
+		RsvpValues     []string
+		Composer       session.ComposerData
+		Can            session.Permissions
+		Error          string
 	}{
-		PageTitle: "Create Post",
-		Photos:    usess.ComposerData.Photos,
-		User:      usess.HCard,
-		Published: usess.ComposerData.Published,
-		Location:  usess.ComposerData.Location.ToHuman(),
+		PageTitle:      "Create Post",
+		CSRFToken:      usess.CSRFToken,
+		Photos:         usess.ComposerData.Photos,
+		Accounts:       usess.Accounts(),
+		Published:      usess.ComposerData.Published,
+		PublishedInput: formatPublishedInput(usess.ComposerData),
+		Location:       usess.ComposerData.Location.ToHuman(),
+		Category:       usess.ComposerData.Category,
+		Syndicate:      syndicationOptions(usess.SyndicateTo, usess.ComposerData.SyndicateTo),
+		PostType:       usess.ComposerData.Type(),
+		PostTypes:      session.PostTypes,
+		RsvpValues:     session.RsvpValues,
+		Composer:       usess.ComposerData,
+		Can:            usess.Permissions(),
+		Error:          errorMessage,
 	}
 	t.ExecuteTemplate(w, "layout", v)
 
@@ -740,7 +2099,7 @@ func (s *server) ShowComposerForm(sessionid string) HttpResponse {
 		"Content-Type": "text/html; charset=UTF-8",
 	}
 	return HttpResponse{
-		StatusCode: http.StatusOK,
+		StatusCode: statusCode,
 		Body:       w.String(),
 		Headers:    headers,
 	}
@@ -838,7 +2197,9 @@ func (client Client) QueryMediaURL(
 	return mediaResponse, nil
 }
 
-func (client Client) QueryPostList(micropubEndpoint, accessToken, afterKey string) (mf2.PostList, error) {
+// QueryPostList fetches a page of posts, postStatus can be used to only
+// list drafts
+func (client Client) QueryPostList(micropubEndpoint, accessToken, afterKey, postStatus string) (mf2.PostList, error) {
 	var postList mf2.PostList
 	var mpURL string
 
@@ -847,6 +2208,9 @@ func (client Client) QueryPostList(micropubEndpoint, accessToken, afterKey strin
 	} else {
 		mpURL = micropubEndpoint + "?q=source&after=" + afterKey
 	}
+	if postStatus != "" {
+		mpURL = mpURL + "&post-status=" + url.QueryEscape(postStatus)
+	}
 
 	client.logger.WithField("endpoint", mpURL).Info("Querying endpoint")
 	req, err := http.NewRequest("GET", mpURL, nil)
@@ -947,6 +2311,208 @@ func (client Client) QueryMonthsList(micropubEndpoint, accessToken, currentYear
 	return postList, nil
 }
 
+// QuerySyndicateTo fetches the syndication targets supported by the
+// micropub endpoint
+func (client Client) QuerySyndicateTo(micropubEndpoint, accessToken string) ([]session.SyndicationTarget, error) {
+	var syndicateResponse struct {
+		SyndicateTo []session.SyndicationTarget `json:"syndicate-to"`
+	}
+
+	mpURL, err := url.Parse(micropubEndpoint)
+	if err != nil {
+		return syndicateResponse.SyndicateTo, err
+	}
+	q := mpURL.Query()
+	q.Set("q", "syndicate-to")
+	mpURL.RawQuery = q.Encode()
+
+	client.logger.WithField("endpoint", mpURL.String()).Info("Querying endpoint")
+	req, err := http.NewRequest("GET", mpURL.String(), nil)
+	if err != nil {
+		return syndicateResponse.SyndicateTo, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	httpclient := &http.Client{}
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to perform GET request")
+		return syndicateResponse.SyndicateTo, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return syndicateResponse.SyndicateTo, fmt.Errorf("micropub endpoint returned a non-200: %d", resp.StatusCode)
+	}
+	// parse response
+	err = json.NewDecoder(resp.Body).Decode(&syndicateResponse)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to decode json")
+		return syndicateResponse.SyndicateTo, err
+	}
+
+	return syndicateResponse.SyndicateTo, nil
+}
+
+// QueryCategories fetches the list of categories used on the site
+func (client Client) QueryCategories(micropubEndpoint, accessToken string) ([]string, error) {
+	var categoryResponse struct {
+		Categories []string `json:"categories"`
+	}
+
+	mpURL, err := url.Parse(micropubEndpoint)
+	if err != nil {
+		return categoryResponse.Categories, err
+	}
+	q := mpURL.Query()
+	q.Set("q", "category")
+	mpURL.RawQuery = q.Encode()
+
+	client.logger.WithField("endpoint", mpURL.String()).Info("Querying endpoint")
+	req, err := http.NewRequest("GET", mpURL.String(), nil)
+	if err != nil {
+		return categoryResponse.Categories, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	httpclient := &http.Client{}
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to perform GET request")
+		return categoryResponse.Categories, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return categoryResponse.Categories, fmt.Errorf("micropub endpoint returned a non-200: %d", resp.StatusCode)
+	}
+	// parse response
+	err = json.NewDecoder(resp.Body).Decode(&categoryResponse)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to decode json")
+		return categoryResponse.Categories, err
+	}
+
+	return categoryResponse.Categories, nil
+}
+
+func (client Client) QuerySource(micropubEndpoint, accessToken, postURL string) (mf2.MicroFormat, error) {
+	var post mf2.MicroFormat
+
+	mpURL, err := url.Parse(micropubEndpoint)
+	if err != nil {
+		return post, err
+	}
+	q := mpURL.Query()
+	q.Set("q", "source")
+	q.Set("url", postURL)
+	mpURL.RawQuery = q.Encode()
+
+	client.logger.WithField("endpoint", mpURL.String()).Info("Querying endpoint")
+	req, err := http.NewRequest("GET", mpURL.String(), nil)
+	if err != nil {
+		return post, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	httpclient := &http.Client{}
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to perform GET request")
+		return post, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return post, fmt.Errorf("micropub endpoint returned a non-200: %d", resp.StatusCode)
+	}
+	respBody := &bytes.Buffer{}
+	_, err = respBody.ReadFrom(resp.Body)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to read GET request body")
+		return post, err
+	}
+	// parse response
+	err = json.Unmarshal(respBody.Bytes(), &post)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to decode json")
+		return post, err
+	}
+
+	return post, nil
+}
+
+func (client Client) SendUpdate(update mf2.Update, mpEndpoint, bearerToken string) (MicropubEndpointResponse, error) {
+	return client.sendJSON(update, mpEndpoint, bearerToken)
+}
+
+// SendJSONRequest sends post to the micropub endpoint as a JSON create
+// request, use this when the post has nested or structured values that
+// can not be form encoded
+func (client Client) SendJSONRequest(post mf2.MicroFormat, mpEndpoint, bearerToken string) (MicropubEndpointResponse, error) {
+	body := struct {
+		Type       []string                 `json:"type"`
+		Properties map[string][]interface{} `json:"properties"`
+	}{
+		Type:       post.Type,
+		Properties: post.Properties,
+	}
+	return client.sendJSON(body, mpEndpoint, bearerToken)
+}
+
+func (client Client) sendJSON(body interface{}, mpEndpoint, bearerToken string) (MicropubEndpointResponse, error) {
+
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to encode json request")
+		return MicropubEndpointResponse{}, err
+	}
+
+	req, err := http.NewRequest("POST", mpEndpoint, bytes.NewReader(jsonBody))
+	if err != nil {
+		client.logger.WithError(err).Error("failed to create request")
+		return MicropubEndpointResponse{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+bearerToken)
+	req.Header.Add("Content-Type", "application/json")
+
+	// perform request
+	client.logger.
+		WithField("micropub_endpoint", mpEndpoint).
+		WithField("body", string(jsonBody)).
+		Info("sending micropub json request")
+	httpclient := &http.Client{}
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		client.logger.WithError(err).Error("failed to perform request")
+		return MicropubEndpointResponse{}, err
+	}
+	defer resp.Body.Close()
+	client.logger.WithField("micropub_response", resp.StatusCode).Info("micropub response")
+
+	return newMicropubEndpointResponse(resp), nil
+}
+
+// Delete sends a micropub delete action for postURL
+func (client Client) Delete(postURL, mpEndpoint, bearerToken string) (MicropubEndpointResponse, error) {
+	return client.sendAction("delete", postURL, mpEndpoint, bearerToken)
+}
+
+// Undelete sends a micropub undelete action for postURL
+func (client Client) Undelete(postURL, mpEndpoint, bearerToken string) (MicropubEndpointResponse, error) {
+	return client.sendAction("undelete", postURL, mpEndpoint, bearerToken)
+}
+
+func (client Client) sendAction(action, postURL, mpEndpoint, bearerToken string) (MicropubEndpointResponse, error) {
+	formData := url.Values{}
+	formData.Set("action", action)
+	formData.Set("url", postURL)
+
+	client.logger.
+		WithField("action", action).
+		WithField("url", postURL).
+		Info("sending micropub action")
+
+	return client.SendRequest(formData, mpEndpoint, bearerToken)
+}
+
 func (client Client) SendRequest(body url.Values, mpEndpoint, bearerToken string) (MicropubEndpointResponse, error) {
 
 	req, err := http.NewRequest("POST", mpEndpoint, strings.NewReader(body.Encode()))
@@ -965,25 +2531,13 @@ func (client Client) SendRequest(body url.Values, mpEndpoint, bearerToken string
 		client.logger.WithError(err).Error("failed to perform request")
 		return MicropubEndpointResponse{}, err
 	}
+	defer resp.Body.Close()
 	client.logger.WithField("micropub_response", resp.StatusCode).Info("micropub response")
 
-	return MicropubEndpointResponse{
-		StatusCode: resp.StatusCode,
-		Location:   resp.Header.Get("location"),
-	}, nil
+	return newMicropubEndpointResponse(resp), nil
 }
 
-func (s *server) ShowAddPhotoForm(sessionid string) HttpResponse {
-
-	// checkSession
-	usess, err := s.SessionStore.FetchByID(sessionid)
-	if err != nil {
-		return HttpResponse{
-			StatusCode: http.StatusInternalServerError,
-			Body:       err.Error(),
-		}
-	}
-	s.logger.WithFields(logrus.Fields{"user": usess}).Info("logged in user")
+func (s *server) ShowAddPhotoForm(usess session.UserSession) HttpResponse {
 
 	// render
 	t, err := template.ParseFiles(
@@ -1001,8 +2555,12 @@ func (s *server) ShowAddPhotoForm(sessionid string) HttpResponse {
 	w := new(bytes.Buffer)
 	v := struct {
 		PageTitle string
+		CSRFToken string
+		Accounts  session.Accounts
 	}{
 		PageTitle: "Add Photo",
+		CSRFToken: usess.CSRFToken,
+		Accounts:  usess.Accounts(),
 	}
 	t.ExecuteTemplate(w, "layout", v)
 
@@ -1017,17 +2575,7 @@ func (s *server) ShowAddPhotoForm(sessionid string) HttpResponse {
 	}
 }
 
-func (s *server) ShowAddLocationForm(sessionid, locationQuery string) HttpResponse {
-
-	// checkSession
-	usess, err := s.SessionStore.FetchByID(sessionid)
-	if err != nil {
-		return HttpResponse{
-			StatusCode: http.StatusInternalServerError,
-			Body:       err.Error(),
-		}
-	}
-	s.logger.WithFields(logrus.Fields{"user": usess}).Info("logged in user")
+func (s *server) ShowAddLocationForm(usess session.UserSession, locationQuery string) HttpResponse {
 
 	locations := s.geocoder.Lookup(locationQuery)
 
@@ -1047,9 +2595,11 @@ func (s *server) ShowAddLocationForm(sessionid, locationQuery string) HttpRespon
 	w := new(bytes.Buffer)
 	v := struct {
 		PageTitle string
+		CSRFToken string
 		Locations []session.Location
 	}{
 		PageTitle: "Add Location",
+		CSRFToken: usess.CSRFToken,
 		Locations: locations,
 	}
 	t.ExecuteTemplate(w, "layout", v)
@@ -2,12 +2,21 @@ package micropub_test
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
+	"github.com/j4y_funabashi/inari-admin/pkg/cookie"
+	"github.com/j4y_funabashi/inari-admin/pkg/deleted"
+	"github.com/j4y_funabashi/inari-admin/pkg/mf2"
 	"github.com/j4y_funabashi/inari-admin/pkg/micropub"
 	"github.com/j4y_funabashi/inari-admin/pkg/mpclient"
+	"github.com/j4y_funabashi/inari-admin/pkg/okami"
+	"github.com/j4y_funabashi/inari-admin/pkg/outbox"
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
 	"github.com/matryer/is"
 	"github.com/sirupsen/logrus"
 )
@@ -88,6 +97,344 @@ func TestMediaQueryList(t *testing.T) {
 
 }
 
+func TestQuerySource(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	accessToken := "test-token"
+	postURL := "http://example.com/post/1"
+	post := mf2.MicroFormat{
+		Type: []string{"h-entry"},
+		Properties: map[string][]interface{}{
+			"content": []interface{}{"hello"},
+		},
+	}
+	var receivedQuery string
+	mpServer := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				receivedQuery = r.URL.RawQuery
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(post)
+			},
+		),
+	)
+	defer mpServer.Close()
+	logger := logrus.New()
+	mpclient := micropub.NewClient(logger)
+
+	// act
+	response, err := mpclient.QuerySource(mpServer.URL, accessToken, postURL)
+
+	// assert
+	is.NoErr(err)
+	is.Equal(receivedQuery, "q=source&url=http%3A%2F%2Fexample.com%2Fpost%2F1")
+	is.Equal(response.GetFirstString("content"), "hello")
+}
+
+func TestQueryCategories(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	var receivedQuery string
+	mpServer := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				receivedQuery = r.URL.RawQuery
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"categories":["cats","dogs"]}`))
+			},
+		),
+	)
+	defer mpServer.Close()
+	logger := logrus.New()
+	mpclient := micropub.NewClient(logger)
+
+	// act
+	categories, err := mpclient.QueryCategories(mpServer.URL, "test-token")
+
+	// assert
+	is.NoErr(err)
+	is.Equal(receivedQuery, "q=category")
+	is.Equal(categories, []string{"cats", "dogs"})
+}
+
+func TestQueryPostListDrafts(t *testing.T) {
+
+	var tests = []struct {
+		name          string
+		afterKey      string
+		postStatus    string
+		expectedQuery string
+	}{
+		{name: "published posts", expectedQuery: "q=source"},
+		{name: "drafts", postStatus: "draft", expectedQuery: "q=source&post-status=draft"},
+		{name: "drafts with paging", afterKey: "abc", postStatus: "draft", expectedQuery: "q=source&after=abc&post-status=draft"},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			var receivedQuery string
+			mpServer := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						receivedQuery = r.URL.RawQuery
+						w.Header().Set("Content-Type", "application/json")
+						w.Write([]byte(`{"items":[]}`))
+					},
+				),
+			)
+			defer mpServer.Close()
+			logger := logrus.New()
+			mpclient := micropub.NewClient(logger)
+
+			// act
+			_, err := mpclient.QueryPostList(mpServer.URL, "test-token", tt.afterKey, tt.postStatus)
+
+			// assert
+			is.NoErr(err)
+			is.Equal(receivedQuery, tt.expectedQuery)
+		})
+	}
+}
+
+func TestQuerySyndicateTo(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	var receivedQuery string
+	mpServer := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				receivedQuery = r.URL.RawQuery
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"syndicate-to":[{"uid":"https://example.social/@jay","name":"@jay on example.social"}]}`))
+			},
+		),
+	)
+	defer mpServer.Close()
+	logger := logrus.New()
+	mpclient := micropub.NewClient(logger)
+
+	// act
+	targets, err := mpclient.QuerySyndicateTo(mpServer.URL, "test-token")
+
+	// assert
+	is.NoErr(err)
+	is.Equal(receivedQuery, "q=syndicate-to")
+	is.Equal(targets, []session.SyndicationTarget{
+		{UID: "https://example.social/@jay", Name: "@jay on example.social"},
+	})
+}
+
+func TestSendUpdate(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	update := mf2.Update{
+		Action:  "update",
+		URL:     "http://example.com/post/1",
+		Replace: map[string][]interface{}{"content": []interface{}{"hello world"}},
+	}
+	var receivedBody []byte
+	var receivedContentType string
+	mpServer := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				receivedContentType = r.Header.Get("Content-Type")
+				receivedBody, _ = ioutil.ReadAll(r.Body)
+				w.WriteHeader(http.StatusNoContent)
+			},
+		),
+	)
+	defer mpServer.Close()
+	logger := logrus.New()
+	mpclient := micropub.NewClient(logger)
+
+	// act
+	response, err := mpclient.SendUpdate(update, mpServer.URL, "test-token")
+
+	// assert
+	is.NoErr(err)
+	is.Equal(response.StatusCode, http.StatusNoContent)
+	is.Equal(receivedContentType, "application/json")
+	is.Equal(
+		string(receivedBody),
+		`{"action":"update","url":"http://example.com/post/1","replace":{"content":["hello world"]}}`,
+	)
+}
+
+func TestSendJSONRequest(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	post := mf2.MicroFormat{
+		Type: []string{"h-entry"},
+		Properties: map[string][]interface{}{
+			"content": []interface{}{map[string]interface{}{"html": "<b>hello</b>"}},
+		},
+	}
+	var receivedBody []byte
+	var receivedContentType string
+	mpServer := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				receivedContentType = r.Header.Get("Content-Type")
+				receivedBody, _ = ioutil.ReadAll(r.Body)
+				w.Header().Set("Location", "http://example.com/post/1")
+				w.WriteHeader(http.StatusCreated)
+			},
+		),
+	)
+	defer mpServer.Close()
+	logger := logrus.New()
+	mpclient := micropub.NewClient(logger)
+
+	// act
+	response, err := mpclient.SendJSONRequest(post, mpServer.URL, "test-token")
+
+	// assert
+	is.NoErr(err)
+	is.Equal(response.StatusCode, http.StatusCreated)
+	is.Equal(response.Location, "http://example.com/post/1")
+	is.Equal(receivedContentType, "application/json")
+	is.Equal(
+		string(receivedBody),
+		`{"type":["h-entry"],"properties":{"content":[{"html":"\u003cb\u003ehello\u003c/b\u003e"}]}}`,
+	)
+}
+
+func TestSendRequestErrors(t *testing.T) {
+
+	var tests = []struct {
+		name              string
+		statusCode        int
+		body              string
+		expected          micropub.MicropubEndpointResponse
+		expectedMessage   string
+		expectedIsSuccess bool
+	}{
+		{
+			name:              "success",
+			statusCode:        http.StatusAccepted,
+			expected:          micropub.MicropubEndpointResponse{StatusCode: http.StatusAccepted},
+			expectedMessage:   "micropub endpoint returned 202",
+			expectedIsSuccess: true,
+		},
+		{
+			name:       "oauth style error",
+			statusCode: http.StatusForbidden,
+			body:       `{"error":"insufficient_scope","error_description":"create scope is required"}`,
+			expected: micropub.MicropubEndpointResponse{
+				StatusCode:       http.StatusForbidden,
+				Error:            "insufficient_scope",
+				ErrorDescription: "create scope is required",
+			},
+			expectedMessage: "micropub endpoint returned 403 insufficient_scope, your access token does not have the required scope: create scope is required",
+		},
+		{
+			name:       "plain text error",
+			statusCode: http.StatusInternalServerError,
+			body:       "database is down\n",
+			expected: micropub.MicropubEndpointResponse{
+				StatusCode:       http.StatusInternalServerError,
+				ErrorDescription: "database is down",
+			},
+			expectedMessage: "micropub endpoint returned 500: database is down",
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			mpServer := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						w.WriteHeader(tt.statusCode)
+						w.Write([]byte(tt.body))
+					},
+				),
+			)
+			defer mpServer.Close()
+			logger := logrus.New()
+			mpclient := micropub.NewClient(logger)
+
+			// act
+			response, err := mpclient.SendRequest(url.Values{"h": {"entry"}}, mpServer.URL, "test-token")
+
+			// assert
+			is.NoErr(err)
+			is.Equal(response, tt.expected)
+			is.Equal(response.IsSuccess(), tt.expectedIsSuccess)
+			is.Equal(response.ErrorMessage(), tt.expectedMessage)
+		})
+	}
+}
+
+func TestDeleteAndUndelete(t *testing.T) {
+
+	var tests = []struct {
+		name   string
+		action string
+	}{
+		{name: "it sends delete", action: "delete"},
+		{name: "it sends undelete", action: "undelete"},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			postURL := "http://example.com/post/1"
+			var receivedAction, receivedURL string
+			mpServer := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						receivedAction = r.FormValue("action")
+						receivedURL = r.FormValue("url")
+						w.WriteHeader(http.StatusNoContent)
+					},
+				),
+			)
+			defer mpServer.Close()
+			logger := logrus.New()
+			mpclient := micropub.NewClient(logger)
+
+			// act
+			var response micropub.MicropubEndpointResponse
+			var err error
+			if tt.action == "delete" {
+				response, err = mpclient.Delete(postURL, mpServer.URL, "test-token")
+			} else {
+				response, err = mpclient.Undelete(postURL, mpServer.URL, "test-token")
+			}
+
+			// assert
+			is.NoErr(err)
+			is.Equal(response.StatusCode, http.StatusNoContent)
+			is.Equal(receivedAction, tt.action)
+			is.Equal(receivedURL, postURL)
+		})
+	}
+}
+
 func getValidMediaList() mpclient.MediaQueryListResponse {
 	return mpclient.MediaQueryListResponse{
 		Items: []mpclient.MediaQueryListResponseItem{
@@ -170,3 +517,369 @@ func newMediaServerSingleItem(t *testing.T, response mpclient.MediaQueryListResp
 		),
 	)
 }
+
+type stubGeoCoder []session.Location
+
+func (geocoder stubGeoCoder) Lookup(address string) []session.Location {
+	return geocoder
+}
+
+func TestFallbackGeoCoder(t *testing.T) {
+
+	leeds := session.Location{Lat: 53.8, Lng: -1.5, Locality: "Leeds"}
+	meanwood := session.Location{Lat: 53.83, Lng: -1.57, Locality: "Meanwood"}
+
+	var tests = []struct {
+		name      string
+		geocoders micropub.FallbackGeoCoder
+		expected  []session.Location
+	}{
+		{
+			name:      "first geocoder finds a location",
+			geocoders: micropub.FallbackGeoCoder{stubGeoCoder{leeds}, stubGeoCoder{meanwood}},
+			expected:  []session.Location{leeds},
+		},
+		{
+			name:      "falls back when nothing is found",
+			geocoders: micropub.FallbackGeoCoder{stubGeoCoder{}, stubGeoCoder{meanwood}},
+			expected:  []session.Location{meanwood},
+		},
+		{
+			name:      "nothing found",
+			geocoders: micropub.FallbackGeoCoder{stubGeoCoder{}, stubGeoCoder{}},
+			expected:  []session.Location{},
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			result := tt.geocoders.Lookup("leeds")
+
+			// assert
+			is.Equal(result, tt.expected)
+		})
+	}
+}
+
+type stubTokens struct{}
+
+func (tokens stubTokens) RefreshIfNeeded(usess session.UserSession, now time.Time) (session.UserSession, error) {
+	return usess, nil
+}
+
+func TestSendOutboxItem(t *testing.T) {
+
+	var tests = []struct {
+		name      string
+		sessions  []session.UserSession
+		sessionID string
+		sent      string
+		permanent bool
+	}{
+		{
+			name: "session that created the item is used",
+			sessions: []session.UserSession{
+				{Uid: "created", Me: "https://example.com/", AccessToken: "created-token", Scope: "create"},
+				{Uid: "other", Me: "https://example.com/", AccessToken: "other-token", Scope: "create"},
+			},
+			sessionID: "created",
+			sent:      "Bearer created-token",
+		},
+		{
+			name: "other sessions for the site are not used when the creating session is gone",
+			sessions: []session.UserSession{
+				{Uid: "other", Me: "https://example.com/", AccessToken: "other-token", Scope: "create"},
+			},
+			sessionID: "created",
+			permanent: true,
+		},
+		{
+			name: "session now logged in to another site is not used",
+			sessions: []session.UserSession{
+				{Uid: "created", Me: "https://other.example.com/", AccessToken: "other-site-token", Scope: "create"},
+			},
+			sessionID: "created",
+			permanent: true,
+		},
+		{
+			name:      "item fails permanently when the site is logged out",
+			sessionID: "created",
+			permanent: true,
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			var receivedAuth string
+			mpServer := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						receivedAuth = r.Header.Get("Authorization")
+						w.Header().Set("Location", "http://example.com/post/1")
+						w.WriteHeader(http.StatusCreated)
+					},
+				),
+			)
+			defer mpServer.Close()
+			store := session.NewMemorySessionStore()
+			for _, usess := range tt.sessions {
+				usess.MicropubEndpoint = mpServer.URL
+				usess.ExpiresAt = time.Now().Add(time.Hour)
+				is.NoErr(store.Create(usess))
+			}
+			logger := logrus.New()
+			server := micropub.NewServer(
+				logger,
+				store,
+				micropub.NewClient(logger),
+				stubGeoCoder{},
+				okami.Server{},
+				outbox.NewMemoryStore(),
+				deleted.NewMemoryStore(),
+				cookie.Jar{},
+				stubTokens{},
+			)
+			post := mf2.MicroFormat{
+				Type:       []string{"h-entry"},
+				Properties: map[string][]interface{}{"content": {"hello"}},
+			}
+			item := outbox.NewItem(tt.sessionID, "https://example.com/", post, time.Now(), time.Now())
+
+			// act
+			err := server.SendOutboxItem(item)
+
+			// assert
+			_, permanent := err.(outbox.PermanentError)
+			is.Equal(permanent, tt.permanent)
+			if !tt.permanent {
+				is.NoErr(err)
+			}
+			is.Equal(receivedAuth, tt.sent)
+		})
+	}
+}
+
+func TestSubmitArticleContent(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		format   string
+		content  string
+		expected interface{}
+	}{
+		{
+			name:     "markdown is sent as html",
+			format:   "markdown",
+			content:  "# Hello\n\nsome *words*",
+			expected: map[string]interface{}{"html": "<h1>Hello</h1>\n\n<p>some <em>words</em></p>\n"},
+		},
+		{
+			name:     "html is sent as it is",
+			format:   "html",
+			content:  "<p>some <em>words</em></p>",
+			expected: map[string]interface{}{"html": "<p>some <em>words</em></p>"},
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			var received mf2.MicroFormat
+			mpServer := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						json.NewDecoder(r.Body).Decode(&received)
+						w.Header().Set("Location", "http://example.com/post/1")
+						w.WriteHeader(http.StatusCreated)
+					},
+				),
+			)
+			defer mpServer.Close()
+			logger := logrus.New()
+			server := micropub.NewServer(
+				logger,
+				session.NewMemorySessionStore(),
+				micropub.NewClient(logger),
+				stubGeoCoder{},
+				okami.Server{},
+				outbox.NewMemoryStore(),
+				deleted.NewMemoryStore(),
+				cookie.Jar{},
+				stubTokens{},
+			)
+			usess := session.UserSession{
+				Uid:              "session",
+				Me:               "https://example.com/",
+				MicropubEndpoint: mpServer.URL,
+				AccessToken:      "token",
+			}
+			form := url.Values{
+				"h":              {"entry"},
+				"post-type":      {"article"},
+				"name":           {"Hello"},
+				"content":        {tt.content},
+				"content-format": {tt.format},
+			}
+
+			// act
+			result := server.SubmitPost(usess, form)
+
+			// assert
+			is.Equal(result.StatusCode, http.StatusSeeOther)
+			is.Equal(received.Properties["content"], []interface{}{tt.expected})
+		})
+	}
+}
+
+func TestUpdateOutboxItemPublishTime(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		tzOffset string
+		expected time.Time
+	}{
+		{
+			name:     "publish time is read in the time zone of the browser",
+			tzOffset: "-300",
+			expected: time.Date(2030, 1, 2, 14, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "publish time east of utc",
+			tzOffset: "330",
+			expected: time.Date(2030, 1, 2, 3, 30, 0, 0, time.UTC),
+		},
+		{
+			name:     "server time zone is used without an offset",
+			tzOffset: "",
+			expected: time.Date(2030, 1, 2, 9, 0, 0, 0, time.Local),
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			logger := logrus.New()
+			obstore := outbox.NewMemoryStore()
+			server := micropub.NewServer(
+				logger,
+				session.NewMemorySessionStore(),
+				micropub.NewClient(logger),
+				stubGeoCoder{},
+				okami.Server{},
+				obstore,
+				deleted.NewMemoryStore(),
+				cookie.Jar{},
+				stubTokens{},
+			)
+			usess := session.UserSession{Uid: "session", Me: "https://example.com/"}
+			post := mf2.MicroFormat{
+				Type:       []string{"h-entry"},
+				Properties: map[string][]interface{}{"content": {"hello"}},
+			}
+			item := outbox.NewItem(usess.Uid, usess.Me, post, time.Now(), time.Now())
+			is.NoErr(obstore.Save(item))
+
+			// act
+			response := server.UpdateOutboxItem(usess, item.ID, "hello", "2030-01-02T09:00", tt.tzOffset)
+
+			// assert
+			is.Equal(response.StatusCode, http.StatusSeeOther)
+			result, err := obstore.FetchByID(item.ID)
+			is.NoErr(err)
+			is.True(result.SendAt.Equal(tt.expected))
+		})
+	}
+}
+
+// outboxActions are the outbox actions of the micropub server
+type outboxActions interface {
+	UpdateOutboxItem(usess session.UserSession, id, content, published, tzOffset string) micropub.HttpResponse
+	RetryOutboxItem(usess session.UserSession, id string) micropub.HttpResponse
+	DiscardOutboxItem(usess session.UserSession, id string) micropub.HttpResponse
+}
+
+func TestOutboxItemBeingSent(t *testing.T) {
+
+	var tests = []struct {
+		name   string
+		action func(server outboxActions, usess session.UserSession, id string) micropub.HttpResponse
+	}{
+		{
+			name: "item being sent can not be edited",
+			action: func(server outboxActions, usess session.UserSession, id string) micropub.HttpResponse {
+				return server.UpdateOutboxItem(usess, id, "edited", "", "")
+			},
+		},
+		{
+			name: "item being sent can not be retried",
+			action: func(server outboxActions, usess session.UserSession, id string) micropub.HttpResponse {
+				return server.RetryOutboxItem(usess, id)
+			},
+		},
+		{
+			name: "item being sent can not be discarded",
+			action: func(server outboxActions, usess session.UserSession, id string) micropub.HttpResponse {
+				return server.DiscardOutboxItem(usess, id)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			logger := logrus.New()
+			obstore := outbox.NewMemoryStore()
+			server := micropub.NewServer(
+				logger,
+				session.NewMemorySessionStore(),
+				micropub.NewClient(logger),
+				stubGeoCoder{},
+				okami.Server{},
+				obstore,
+				deleted.NewMemoryStore(),
+				cookie.Jar{},
+				stubTokens{},
+			)
+			usess := session.UserSession{Uid: "session", Me: "https://example.com/"}
+			post := mf2.MicroFormat{
+				Type:       []string{"h-entry"},
+				Properties: map[string][]interface{}{"content": {"hello"}},
+			}
+			item := outbox.NewItem(usess.Uid, usess.Me, post, time.Now(), time.Now())
+			is.NoErr(item.Claim(time.Now()))
+			is.NoErr(obstore.Save(item))
+
+			// act
+			response := tt.action(&server, usess, item.ID)
+
+			// assert
+			is.Equal(response.StatusCode, http.StatusConflict)
+			result, err := obstore.FetchByID(item.ID)
+			is.NoErr(err)
+			is.Equal(result.Status, outbox.StatusSending)
+			is.Equal(result.Content(), "hello")
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package osm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxResults is how many places are asked for in a search
+const maxResults = 10
+
+// Geocoder looks up places with an OpenStreetMap geocoder, either
+// Nominatim or Photon as both take the same q, lat and lon parameters
+type Geocoder struct {
+	searchURL  string
+	reverseURL string
+	userAgent  string
+	logger     *log.Logger
+}
+
+// NewGeocoder creates a geocoder, the Nominatim usage policy asks for a
+// userAgent that identifies the app
+func NewGeocoder(searchURL, reverseURL, userAgent string, logger *log.Logger) Geocoder {
+	return Geocoder{
+		searchURL:  searchURL,
+		reverseURL: reverseURL,
+		userAgent:  userAgent,
+		logger:     logger,
+	}
+}
+
+// nominatimPlace is a search result, or the whole response of a reverse
+// lookup, from Nominatim
+type nominatimPlace struct {
+	Lat     string           `json:"lat"`
+	Lon     string           `json:"lon"`
+	Address nominatimAddress `json:"address"`
+}
+
+type nominatimAddress struct {
+	City          string `json:"city"`
+	Town          string `json:"town"`
+	Village       string `json:"village"`
+	Hamlet        string `json:"hamlet"`
+	Suburb        string `json:"suburb"`
+	Municipality  string `json:"municipality"`
+	County        string `json:"county"`
+	StateDistrict string `json:"state_district"`
+	State         string `json:"state"`
+	Country       string `json:"country"`
+}
+
+func (place nominatimPlace) toLocation() (session.Location, error) {
+	lat, err := strconv.ParseFloat(place.Lat, 64)
+	if err != nil {
+		return session.Location{}, fmt.Errorf("invalid lat %q", place.Lat)
+	}
+	lng, err := strconv.ParseFloat(place.Lon, 64)
+	if err != nil {
+		return session.Location{}, fmt.Errorf("invalid lon %q", place.Lon)
+	}
+	address := place.Address
+	return session.Location{
+		Lat:      lat,
+		Lng:      lng,
+		Locality: firstOf(address.City, address.Town, address.Village, address.Hamlet, address.Suburb, address.Municipality),
+		Region:   firstOf(address.County, address.StateDistrict, address.State),
+		Country:  address.Country,
+	}, nil
+}
+
+// photonFeature is a place in the GeoJSON returned by Photon
+type photonFeature struct {
+	Geometry struct {
+		// Coordinates are lng, lat
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties struct {
+		Name     string `json:"name"`
+		Type     string `json:"type"`
+		City     string `json:"city"`
+		District string `json:"district"`
+		County   string `json:"county"`
+		State    string `json:"state"`
+		Country  string `json:"country"`
+	} `json:"properties"`
+}
+
+func (feature photonFeature) toLocation() (session.Location, error) {
+	if len(feature.Geometry.Coordinates) != 2 {
+		return session.Location{}, fmt.Errorf("invalid coordinates %v", feature.Geometry.Coordinates)
+	}
+	props := feature.Properties
+	locality := firstOf(props.City, props.District)
+	if locality == "" && (props.Type == "city" || props.Type == "locality") {
+		locality = props.Name
+	}
+	return session.Location{
+		Lat:      feature.Geometry.Coordinates[1],
+		Lng:      feature.Geometry.Coordinates[0],
+		Locality: locality,
+		Region:   firstOf(props.County, props.State),
+		Country:  props.Country,
+	}, nil
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (geocoder Geocoder) Lookup(address string) []session.Location {
+	q := url.Values{}
+	q.Add("q", address)
+	q.Add("limit", strconv.Itoa(maxResults))
+	return geocoder.query(geocoder.searchURL, q)
+}
+
+func (geocoder Geocoder) LookupLatLng(lat, lng float64) []session.Location {
+	q := url.Values{}
+	q.Add("lat", strconv.FormatFloat(lat, 'g', -1, 64))
+	q.Add("lon", strconv.FormatFloat(lng, 'g', -1, 64))
+	return geocoder.query(geocoder.reverseURL, q)
+}
+
+func (geocoder Geocoder) query(baseURL string, params url.Values) []session.Location {
+	locList := []session.Location{}
+
+	// build url
+	apiBaseURL, err := url.Parse(baseURL)
+	if err != nil {
+		geocoder.logger.WithError(err).Error("failed to parse url")
+		return locList
+	}
+	q := apiBaseURL.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	q.Set("format", "jsonv2")
+	q.Set("addressdetails", "1")
+	apiBaseURL.RawQuery = q.Encode()
+	geocoder.logger.WithField("url", apiBaseURL).Info("venue search")
+
+	// call url
+	req, err := http.NewRequest("GET", apiBaseURL.String(), nil)
+	if err != nil {
+		geocoder.logger.WithError(err).Error("failed to build request")
+		return locList
+	}
+	req.Header.Set("User-Agent", geocoder.userAgent)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		geocoder.logger.WithError(err).Error("failed to GET")
+		return locList
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		geocoder.logger.WithField("status", resp.StatusCode).Error("geocoder returned a non-200")
+		return locList
+	}
+
+	// parse response
+	buf := bytes.Buffer{}
+	buf.ReadFrom(resp.Body)
+	locList, err = parseLocations(buf.Bytes())
+	if err != nil {
+		geocoder.logger.WithError(err).Error("failed to unmarshal geocode response")
+		return []session.Location{}
+	}
+
+	geocoder.logger.
+		WithField("locList", locList).Info("response")
+	return locList
+}
+
+// parseLocations reads Nominatim search results, a Nominatim reverse
+// lookup or Photon GeoJSON
+func parseLocations(body []byte) ([]session.Location, error) {
+	locList := []session.Location{}
+
+	var places []nominatimPlace
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		err := json.Unmarshal(body, &places)
+		if err != nil {
+			return locList, err
+		}
+	} else {
+		var res struct {
+			nominatimPlace
+			Features []photonFeature `json:"features"`
+			Error    interface{}     `json:"error"`
+		}
+		err := json.Unmarshal(body, &res)
+		if err != nil {
+			return locList, err
+		}
+		if res.Error != nil {
+			return locList, fmt.Errorf("geocoder returned an error: %v", res.Error)
+		}
+		if res.Features != nil {
+			for _, feature := range res.Features {
+				loc, err := feature.toLocation()
+				if err != nil {
+					return []session.Location{}, err
+				}
+				locList = append(locList, loc)
+			}
+			return locList, nil
+		}
+		// reverse lookups return a single place
+		places = append(places, res.nominatimPlace)
+	}
+
+	for _, place := range places {
+		loc, err := place.toLocation()
+		if err != nil {
+			return []session.Location{}, err
+		}
+		locList = append(locList, loc)
+	}
+	return locList, nil
+}
@@ -0,0 +1,124 @@
+package osm_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/osm"
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
+	"github.com/matryer/is"
+	log "github.com/sirupsen/logrus"
+)
+
+// newReplayServer answers every request with a recorded response
+func newReplayServer(t *testing.T, fixture string, statusCode int, requests *[]*http.Request) *httptest.Server {
+	body, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %s", err.Error())
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		w.Write(body)
+	}))
+}
+
+func newTestGeocoder(serverURL string) osm.Geocoder {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	return osm.NewGeocoder(serverURL+"/search", serverURL+"/reverse", "inari-admin-test", logger)
+}
+
+func TestLookup(t *testing.T) {
+
+	var tests = []struct {
+		name       string
+		fixture    string
+		statusCode int
+		expected   []session.Location
+	}{
+		{
+			name:       "nominatim",
+			fixture:    "search.json",
+			statusCode: http.StatusOK,
+			expected: []session.Location{
+				{Lat: 53.8326013, Lng: -1.5699349, Locality: "Leeds", Region: "West Yorkshire", Country: "United Kingdom"},
+				{Lat: 53.8364152, Lng: -1.5753987, Locality: "Leeds", Region: "West Yorkshire", Country: "United Kingdom"},
+				{Lat: 45.6519211, Lng: 13.7804987, Locality: "Opatje selo", Region: "Goriška", Country: "Slovenija"},
+			},
+		},
+		{
+			name:       "photon",
+			fixture:    "photon.json",
+			statusCode: http.StatusOK,
+			expected: []session.Location{
+				{Lat: 53.8326013, Lng: -1.5699349, Locality: "Leeds", Region: "West Yorkshire", Country: "United Kingdom"},
+				{Lat: 53.7974185, Lng: -1.5491221, Locality: "Leeds", Region: "West Yorkshire", Country: "United Kingdom"},
+			},
+		},
+		{
+			name:       "error",
+			fixture:    "error.json",
+			statusCode: http.StatusBadRequest,
+			expected:   []session.Location{},
+		},
+		{
+			name:       "error with a 200",
+			fixture:    "error.json",
+			statusCode: http.StatusOK,
+			expected:   []session.Location{},
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			var requests []*http.Request
+			server := newReplayServer(t, tt.fixture, tt.statusCode, &requests)
+			defer server.Close()
+			sut := newTestGeocoder(server.URL)
+
+			// act
+			result := sut.Lookup("meanwood")
+
+			// assert
+			is.Equal(result, tt.expected)
+			is.Equal(len(requests), 1)
+			is.Equal(requests[0].URL.Path, "/search")
+			is.Equal(requests[0].URL.Query().Get("q"), "meanwood")
+			is.Equal(requests[0].URL.Query().Get("format"), "jsonv2")
+			is.Equal(requests[0].Header.Get("User-Agent"), "inari-admin-test")
+		})
+	}
+}
+
+func TestLookupLatLng(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	var requests []*http.Request
+	server := newReplayServer(t, "reverse.json", http.StatusOK, &requests)
+	defer server.Close()
+	sut := newTestGeocoder(server.URL)
+
+	// act
+	result := sut.LookupLatLng(53.80097961111111, -1.5413867222222222)
+
+	// assert
+	is.Equal(result, []session.Location{
+		{Lat: 53.80094705, Lng: -1.5413912, Locality: "Leeds", Region: "West Yorkshire", Country: "United Kingdom"},
+	})
+	is.Equal(len(requests), 1)
+	is.Equal(requests[0].URL.Path, "/reverse")
+	is.Equal(requests[0].URL.Query().Get("lat"), "53.80097961111111")
+	is.Equal(requests[0].URL.Query().Get("lon"), "-1.5413867222222222")
+}
@@ -0,0 +1,776 @@
+package outbox
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/j4y_funabashi/inari-admin/pkg/mf2"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// StatusScheduled items are sent at their published time
+	StatusScheduled = "scheduled"
+	// StatusPending items could not be sent and are being retried
+	StatusPending = "pending"
+	// StatusFailed items are no longer retried
+	StatusFailed = "failed"
+	// StatusSending items have been claimed by a sender until their lease
+	// runs out
+	StatusSending = "sending"
+)
+
+// LeaseTime is how long a sender holds an item, an item left sending
+// after its lease, because the sender stopped, is sent again
+const LeaseTime = 10 * time.Minute
+
+// ErrSending is returned when changing an item that is being sent
+var ErrSending = errors.New("outbox item is being sent")
+
+// MaxAttempts is how many times an item is sent before it is marked as
+// failed
+const MaxAttempts = 8
+
+const (
+	minBackoff = time.Minute
+	maxBackoff = time.Hour
+)
+
+// Store persists outbox items so they survive restarts
+type Store interface {
+	Save(item Item) error
+	FetchByID(id string) (Item, error)
+	List() ([]Item, error)
+	Delete(id string) error
+	// Update changes the stored item with fn, the change is only saved
+	// when fn returns nil and no other update can happen in between
+	Update(id string, fn func(item *Item) error) (Item, error)
+}
+
+// PermanentError marks a send error that will not go away by retrying,
+// such as the endpoint rejecting the post
+type PermanentError struct {
+	Err error
+}
+
+func (e PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Item is a micropub create request waiting to be sent
+type Item struct {
+	ID        string          `json:"id"`
+	SessionID string          `json:"session_id"`
+	Me        string          `json:"me"`
+	Post      mf2.MicroFormat `json:"post"`
+	SendAt    time.Time       `json:"send_at"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error"`
+	CreatedAt time.Time       `json:"created_at"`
+	// LeaseUntil is when a sending item can be claimed again
+	LeaseUntil time.Time `json:"lease_until"`
+}
+
+func NewItem(sessionID, me string, post mf2.MicroFormat, sendAt, now time.Time) Item {
+	return Item{
+		ID:        uuid.NewV4().String(),
+		SessionID: sessionID,
+		Me:        me,
+		Post:      post,
+		SendAt:    sendAt,
+		Status:    StatusScheduled,
+		CreatedAt: now,
+	}
+}
+
+// NewPendingItem creates an item for a post that failed to send with
+// err, it is retried after a backoff
+func NewPendingItem(sessionID, me string, post mf2.MicroFormat, err error, now time.Time) Item {
+	item := NewItem(sessionID, me, post, now, now)
+	item.Status = StatusPending
+	item.Failed(err, now)
+	return item
+}
+
+// Due is true when the item should be sent at now
+func (item Item) Due(now time.Time) bool {
+	switch item.Status {
+	case StatusScheduled, StatusPending:
+		return !item.SendAt.After(now)
+	case StatusSending:
+		return !item.Sending(now)
+	}
+	return false
+}
+
+// Sending is true while a sender holds the item
+func (item Item) Sending(now time.Time) bool {
+	return item.Status == StatusSending && item.LeaseUntil.After(now)
+}
+
+// Claim marks the item as sending so no other sender picks it up, items
+// already being sent return ErrSending
+func (item *Item) Claim(now time.Time) error {
+	if item.Sending(now) {
+		return ErrSending
+	}
+	item.Status = StatusSending
+	item.LeaseUntil = now.Add(LeaseTime)
+	return nil
+}
+
+// Failed records a failed attempt and schedules the next retry
+func (item *Item) Failed(err error, now time.Time) {
+	item.Attempts++
+	item.LastError = err.Error()
+	item.LeaseUntil = time.Time{}
+	if _, ok := err.(PermanentError); ok || item.Attempts >= MaxAttempts {
+		item.Status = StatusFailed
+		return
+	}
+	item.Status = StatusPending
+	item.SendAt = now.Add(Backoff(item.Attempts))
+}
+
+// Retry queues the item to be sent again at now
+func (item *Item) Retry(now time.Time) {
+	item.SendAt = now
+	item.Status = StatusPending
+	item.Attempts = 0
+	item.LastError = ""
+	item.LeaseUntil = time.Time{}
+}
+
+// Reschedule sets a new publish time and resets any failed attempts
+func (item *Item) Reschedule(sendAt time.Time) {
+	item.SendAt = sendAt
+	item.Status = StatusScheduled
+	item.Attempts = 0
+	item.LastError = ""
+	item.LeaseUntil = time.Time{}
+	item.Post.Properties["published"] = []interface{}{sendAt.Format(time.RFC3339)}
+}
+
+// Content returns the text content of the post
+func (item Item) Content() string {
+	content := item.Post.Properties["content"]
+	if len(content) == 0 {
+		return ""
+	}
+	switch v := content[0].(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		if html, ok := v["html"].(string); ok {
+			return html
+		}
+		if value, ok := v["value"].(string); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// SetContent replaces the content of the post, keeping html content as
+// html
+func (item *Item) SetContent(content string) {
+	if strings.TrimSpace(content) == "" {
+		delete(item.Post.Properties, "content")
+		return
+	}
+	old := item.Post.Properties["content"]
+	if len(old) > 0 {
+		if v, ok := old[0].(map[string]interface{}); ok {
+			if _, ok := v["html"]; ok {
+				item.Post.Properties["content"] = []interface{}{map[string]interface{}{"html": content}}
+				return
+			}
+		}
+	}
+	item.Post.Properties["content"] = []interface{}{content}
+}
+
+// Backoff is how long to wait before the next attempt, doubling from a
+// minute up to an hour
+func Backoff(attempts int) time.Duration {
+	backoff := minBackoff
+	for i := 1; i < attempts; i++ {
+		backoff = backoff * 2
+		if backoff >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return backoff
+}
+
+// ListForUser returns the items belonging to me, soonest first
+func ListForUser(store Store, me string) ([]Item, error) {
+	var out []Item
+	items, err := store.List()
+	if err != nil {
+		return out, err
+	}
+	for _, item := range items {
+		if item.Me == me {
+			out = append(out, item)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool {
+		return out[a].SendAt.Before(out[b].SendAt)
+	})
+	return out, nil
+}
+
+// SendFunc sends an item to its micropub endpoint
+type SendFunc func(item Item) error
+
+type Worker struct {
+	store  Store
+	send   SendFunc
+	logger *logrus.Logger
+}
+
+func NewWorker(store Store, send SendFunc, logger *logrus.Logger) Worker {
+	return Worker{
+		store:  store,
+		send:   send,
+		logger: logger,
+	}
+}
+
+// Run checks for due items every interval, forever
+func (w Worker) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		w.ProcessDue(now)
+	}
+}
+
+// errNotDue stops a claim on an item that changed since it was listed
+var errNotDue = errors.New("outbox item is not due")
+
+// ProcessDue sends every item that is due at now, removing sent items
+// and rescheduling failed ones
+func (w Worker) ProcessDue(now time.Time) {
+	items, err := w.store.List()
+	if err != nil {
+		w.logger.WithError(err).Error("failed to list outbox")
+		return
+	}
+
+	for _, item := range items {
+		if !item.Due(now) {
+			continue
+		}
+
+		// claim the item first so it is not sent twice, the claimed copy
+		// has any edits made since it was listed
+		claimed, err := w.store.Update(item.ID, func(item *Item) error {
+			if !item.Due(now) {
+				return errNotDue
+			}
+			return item.Claim(now)
+		})
+		if err != nil {
+			w.logger.WithError(err).WithField("id", item.ID).Info("skipped outbox item")
+			continue
+		}
+
+		Send(w.store, w.send, claimed, now, w.logger)
+	}
+}
+
+// Send sends a claimed item, removing it once sent and rescheduling it
+// when sending fails
+func Send(store Store, send SendFunc, item Item, now time.Time, logger *logrus.Logger) error {
+	sendErr := send(item)
+	if sendErr != nil {
+		logger.
+			WithError(sendErr).
+			WithField("id", item.ID).
+			WithField("attempts", item.Attempts+1).
+			Info("failed to send outbox item")
+		_, err := store.Update(item.ID, func(item *Item) error {
+			item.Failed(sendErr, now)
+			return nil
+		})
+		if err != nil {
+			logger.WithError(err).Error("failed to save outbox item")
+		}
+		return sendErr
+	}
+
+	logger.WithField("id", item.ID).Info("sent outbox item")
+	err := store.Delete(item.ID)
+	if err != nil {
+		logger.WithError(err).Error("failed to delete outbox item")
+	}
+	return nil
+}
+
+// NewStore creates an outbox store from the same URL as the session
+// store, so the outbox is kept next to the sessions:
+//
+//	s3://bucket?region=eu-central-1
+//	file:///var/lib/inari-admin/sessions
+//	sqlite:///var/lib/inari-admin/sessions.db
+//	memory://
+func NewStore(storeURL string) (Store, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse outbox store url: %v", err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		region := u.Query().Get("region")
+		if region == "" {
+			region = "eu-central-1"
+		}
+		return NewS3Store(region, u.Host)
+	case "file":
+		return NewFileStore(filepath.Join(u.Host+u.Path, "outbox"))
+	case "sqlite":
+		return NewSQLiteStore(u.Host + u.Path)
+	case "memory":
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown outbox store %q", u.Scheme)
+}
+
+type memoryStore struct {
+	mu    *sync.Mutex
+	items map[string]Item
+}
+
+func NewMemoryStore() Store {
+	return memoryStore{
+		mu:    &sync.Mutex{},
+		items: make(map[string]Item),
+	}
+}
+
+func (s memoryStore) Save(item Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[item.ID] = item
+	return nil
+}
+
+func (s memoryStore) FetchByID(id string) (Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[id]
+	if !ok {
+		return item, fmt.Errorf("outbox item %s not found", id)
+	}
+	return item, nil
+}
+
+func (s memoryStore) List() ([]Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Item
+	for _, item := range s.items {
+		out = append(out, item)
+	}
+	return out, nil
+}
+
+func (s memoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, id)
+	return nil
+}
+
+func (s memoryStore) Update(id string, fn func(item *Item) error) (Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[id]
+	if !ok {
+		return item, fmt.Errorf("outbox item %s not found", id)
+	}
+	err := fn(&item)
+	if err != nil {
+		return item, err
+	}
+	s.items[id] = item
+	return item, nil
+}
+
+type fileStore struct {
+	dir string
+	mu  *sync.Mutex
+}
+
+// NewFileStore keeps each item as a json file in dir, updates are only
+// atomic within a single process
+func NewFileStore(dir string) (Store, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fileStore{}, err
+	}
+	return fileStore{dir: dir, mu: &sync.Mutex{}}, nil
+}
+
+func (s fileStore) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, "/\\.") {
+		return "", fmt.Errorf("invalid outbox item id %q", id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+func (s fileStore) Save(item Item) error {
+	path, err := s.path(item.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode json %v", err)
+	}
+
+	// write to a temp file first so a crash never leaves half an item
+	tmp, err := ioutil.TempFile(s.dir, "item")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s fileStore) FetchByID(id string) (Item, error) {
+	var item Item
+	path, err := s.path(id)
+	if err != nil {
+		return item, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return item, fmt.Errorf("outbox item %s not found", id)
+	}
+	if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal(data, &item)
+	return item, err
+}
+
+// List skips and logs items that can not be read, so one bad file does
+// not stop the worker or hide the rest of the outbox
+func (s fileStore) List() ([]Item, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var items []Item
+	for _, path := range paths {
+		var item Item
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("failed to read outbox item [%s][%s]", path, err.Error())
+			continue
+		}
+		err = json.Unmarshal(data, &item)
+		if err != nil {
+			log.Printf("failed to decode outbox item [%s][%s]", path, err.Error())
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (s fileStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s fileStore) Update(id string, fn func(item *Item) error) (Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, err := s.FetchByID(id)
+	if err != nil {
+		return item, err
+	}
+	err = fn(&item)
+	if err != nil {
+		return item, err
+	}
+	return item, s.Save(item)
+}
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore keeps items in a sqlite database at path, creating it if
+// needed, it can share a database with the session store
+func NewSQLiteStore(path string) (Store, error) {
+	// immediate transactions lock the database for the whole of an update
+	db, err := sql.Open("sqlite3", path+"?_txlock=immediate&_busy_timeout=5000")
+	if err != nil {
+		return sqliteStore{}, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS outbox (
+		id TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return sqliteStore{}, err
+	}
+	return sqliteStore{db: db}, nil
+}
+
+func (s sqliteStore) Save(item Item) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode json %v", err)
+	}
+	_, err = s.db.Exec(
+		"INSERT OR REPLACE INTO outbox (id, data) VALUES (?, ?)",
+		item.ID,
+		string(data),
+	)
+	return err
+}
+
+func (s sqliteStore) FetchByID(id string) (Item, error) {
+	var item Item
+	var data string
+	err := s.db.QueryRow("SELECT data FROM outbox WHERE id = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return item, fmt.Errorf("outbox item %s not found", id)
+	}
+	if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal([]byte(data), &item)
+	return item, err
+}
+
+// List skips and logs rows that can not be decoded
+func (s sqliteStore) List() ([]Item, error) {
+	rows, err := s.db.Query("SELECT id, data FROM outbox")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []Item
+	for rows.Next() {
+		var item Item
+		var id, data string
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(data), &item)
+		if err != nil {
+			log.Printf("failed to decode outbox item [%s][%s]", id, err.Error())
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (s sqliteStore) Delete(id string) error {
+	_, err := s.db.Exec("DELETE FROM outbox WHERE id = ?", id)
+	return err
+}
+
+func (s sqliteStore) Update(id string, fn func(item *Item) error) (Item, error) {
+	var item Item
+	tx, err := s.db.Begin()
+	if err != nil {
+		return item, err
+	}
+	defer tx.Rollback()
+
+	var data string
+	err = tx.QueryRow("SELECT data FROM outbox WHERE id = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return item, fmt.Errorf("outbox item %s not found", id)
+	}
+	if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal([]byte(data), &item)
+	if err != nil {
+		return item, err
+	}
+
+	err = fn(&item)
+	if err != nil {
+		return item, err
+	}
+	updated, err := json.Marshal(item)
+	if err != nil {
+		return item, fmt.Errorf("failed to encode json %v", err)
+	}
+	_, err = tx.Exec("UPDATE outbox SET data = ? WHERE id = ?", string(updated), id)
+	if err != nil {
+		return item, err
+	}
+	return item, tx.Commit()
+}
+
+type s3Store struct {
+	client     *s3.S3
+	downloader *s3manager.Downloader
+	uploader   *s3manager.Uploader
+	bucket     string
+	mu         *sync.Mutex
+}
+
+const s3Prefix = "outbox/"
+
+// NewS3Store keeps each item as a json object in bucket. S3 has no
+// conditional writes to claim an item with, so updates are only atomic
+// within a single process and the bucket must only be used by one running
+// instance, or a post can be sent twice
+func NewS3Store(region, bucket string) (Store, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	if err != nil {
+		return s3Store{}, err
+	}
+	return s3Store{
+		client:     s3.New(sess),
+		downloader: s3manager.NewDownloader(sess),
+		uploader:   s3manager.NewUploader(sess),
+		bucket:     bucket,
+		mu:         &sync.Mutex{},
+	}, nil
+}
+
+func (s s3Store) Save(item Item) error {
+	data := new(bytes.Buffer)
+	err := json.NewEncoder(data).Encode(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode json %v", err)
+	}
+
+	_, err = s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s3Prefix + item.ID + ".json"),
+		Body:   data,
+		ACL:    aws.String("private"),
+	})
+	return err
+}
+
+func (s s3Store) FetchByID(id string) (Item, error) {
+	var item Item
+
+	buf := aws.NewWriteAtBuffer([]byte{})
+	_, err := s.downloader.Download(buf, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s3Prefix + id + ".json"),
+	})
+	if err != nil {
+		return item, err
+	}
+
+	err = json.Unmarshal(buf.Bytes(), &item)
+	return item, err
+}
+
+// List downloads every item, items that can not be downloaded or decoded,
+// such as one deleted since the listing, are logged and skipped
+func (s s3Store) List() ([]Item, error) {
+	var keys []string
+	err := s.client.ListObjectsV2Pages(
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(s3Prefix),
+		},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				keys = append(keys, *obj.Key)
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []Item
+	for _, key := range keys {
+		id := strings.TrimSuffix(strings.TrimPrefix(key, s3Prefix), ".json")
+		item, err := s.FetchByID(id)
+		if err != nil {
+			log.Printf("failed to fetch outbox item [%s][%s]", key, err.Error())
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (s s3Store) Update(id string, fn func(item *Item) error) (Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, err := s.FetchByID(id)
+	if err != nil {
+		return item, err
+	}
+	err = fn(&item)
+	if err != nil {
+		return item, err
+	}
+	return item, s.Save(item)
+}
+
+func (s s3Store) Delete(id string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s3Prefix + id + ".json"),
+	})
+	return err
+}
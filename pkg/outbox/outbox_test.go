@@ -0,0 +1,408 @@
+package outbox_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/mf2"
+	"github.com/j4y_funabashi/inari-admin/pkg/outbox"
+	"github.com/matryer/is"
+	"github.com/sirupsen/logrus"
+)
+
+func TestBackoff(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		attempts int
+		expected time.Duration
+	}{
+		{name: "first retry", attempts: 1, expected: time.Minute},
+		{name: "doubles", attempts: 3, expected: 4 * time.Minute},
+		{name: "capped at an hour", attempts: 10, expected: time.Hour},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			result := outbox.Backoff(tt.attempts)
+
+			// assert
+			is.Equal(result, tt.expected)
+		})
+	}
+}
+
+func TestProcessDue(t *testing.T) {
+
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name             string
+		sendAt           time.Time
+		status           string
+		attempts         int
+		leaseUntil       time.Time
+		sendErr          error
+		expectSent       bool
+		expectDeleted    bool
+		expectedStatus   string
+		expectedAttempts int
+		expectedSendAt   time.Time
+	}{
+		{
+			name:          "due item is sent and removed",
+			sendAt:        now.Add(-time.Minute),
+			expectSent:    true,
+			expectDeleted: true,
+		},
+		{
+			name:           "future item is left alone",
+			sendAt:         now.Add(time.Hour),
+			expectedStatus: outbox.StatusScheduled,
+			expectedSendAt: now.Add(time.Hour),
+		},
+		{
+			name:             "failed send is retried with backoff",
+			sendAt:           now,
+			sendErr:          errors.New("endpoint is down"),
+			expectSent:       true,
+			expectedStatus:   outbox.StatusPending,
+			expectedAttempts: 1,
+			expectedSendAt:   now.Add(time.Minute),
+		},
+		{
+			name:          "due pending item is sent and removed",
+			sendAt:        now,
+			status:        outbox.StatusPending,
+			attempts:      2,
+			expectSent:    true,
+			expectDeleted: true,
+		},
+		{
+			name:             "rejected post is not retried",
+			sendAt:           now,
+			sendErr:          outbox.PermanentError{Err: errors.New("invalid_request")},
+			expectSent:       true,
+			expectedStatus:   outbox.StatusFailed,
+			expectedAttempts: 1,
+			expectedSendAt:   now,
+		},
+		{
+			name:             "failed item is left alone",
+			sendAt:           now.Add(-time.Hour),
+			status:           outbox.StatusFailed,
+			attempts:         3,
+			expectedStatus:   outbox.StatusFailed,
+			expectedAttempts: 3,
+			expectedSendAt:   now.Add(-time.Hour),
+		},
+		{
+			name:           "item being sent is left alone",
+			sendAt:         now.Add(-time.Minute),
+			status:         outbox.StatusSending,
+			leaseUntil:     now.Add(time.Minute),
+			expectedStatus: outbox.StatusSending,
+			expectedSendAt: now.Add(-time.Minute),
+		},
+		{
+			name:          "item left sending after its lease is sent again",
+			sendAt:        now.Add(-time.Hour),
+			status:        outbox.StatusSending,
+			leaseUntil:    now.Add(-time.Minute),
+			expectSent:    true,
+			expectDeleted: true,
+		},
+		{
+			name:             "item is failed after max attempts",
+			sendAt:           now,
+			attempts:         outbox.MaxAttempts - 1,
+			sendErr:          errors.New("endpoint is down"),
+			expectSent:       true,
+			expectedStatus:   outbox.StatusFailed,
+			expectedAttempts: outbox.MaxAttempts,
+			expectedSendAt:   now,
+		},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			store := outbox.NewMemoryStore()
+			post := mf2.MicroFormat{
+				Type:       []string{"h-entry"},
+				Properties: map[string][]interface{}{"content": {"hello"}},
+			}
+			item := outbox.NewItem("session-1", "https://example.com/", post, tt.sendAt, now)
+			item.Attempts = tt.attempts
+			item.LeaseUntil = tt.leaseUntil
+			if tt.status != "" {
+				item.Status = tt.status
+			}
+			is.NoErr(store.Save(item))
+
+			sent := false
+			send := func(item outbox.Item) error {
+				sent = true
+				// the item is claimed while it is sent
+				stored, err := store.FetchByID(item.ID)
+				is.NoErr(err)
+				is.True(stored.Sending(now))
+				return tt.sendErr
+			}
+			worker := outbox.NewWorker(store, send, logrus.New())
+
+			// act
+			worker.ProcessDue(now)
+
+			// assert
+			is.Equal(sent, tt.expectSent)
+			result, err := store.FetchByID(item.ID)
+			if tt.expectDeleted {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(result.Status, tt.expectedStatus)
+			is.Equal(result.Attempts, tt.expectedAttempts)
+			is.True(result.SendAt.Equal(tt.expectedSendAt))
+		})
+	}
+}
+
+func TestClaim(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	post := mf2.MicroFormat{
+		Type:       []string{"h-entry"},
+		Properties: map[string][]interface{}{"content": {"hello"}},
+	}
+	item := outbox.NewItem("session-1", "https://example.com/", post, now, now)
+
+	// act + assert
+	is.NoErr(item.Claim(now))
+	is.Equal(item.Status, outbox.StatusSending)
+	is.Equal(item.Claim(now.Add(time.Minute)), outbox.ErrSending)
+	is.NoErr(item.Claim(now.Add(outbox.LeaseTime)))
+}
+
+func TestReschedule(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	post := mf2.MicroFormat{
+		Type:       []string{"h-entry"},
+		Properties: map[string][]interface{}{"content": {map[string]interface{}{"html": "<p>hi</p>"}}},
+	}
+	item := outbox.NewItem("session-1", "https://example.com/", post, now, now)
+	item.Failed(errors.New("boom"), now)
+
+	// act
+	item.Reschedule(now.Add(24 * time.Hour))
+	item.SetContent("<p>hello</p>")
+
+	// assert
+	is.Equal(item.Status, outbox.StatusScheduled)
+	is.Equal(item.Attempts, 0)
+	is.Equal(item.LastError, "")
+	is.Equal(item.Post.Properties["published"], []interface{}{"2019-05-02T12:00:00Z"})
+	is.Equal(item.Content(), "<p>hello</p>")
+}
+
+func TestNewPendingItem(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	post := mf2.MicroFormat{
+		Type:       []string{"h-entry"},
+		Properties: map[string][]interface{}{"content": {"hello"}},
+	}
+
+	// act
+	item := outbox.NewPendingItem("session-1", "https://example.com/", post, errors.New("no route to host"), now)
+
+	// assert
+	is.Equal(item.Status, outbox.StatusPending)
+	is.Equal(item.Attempts, 1)
+	is.Equal(item.LastError, "no route to host")
+	is.True(item.SendAt.Equal(now.Add(time.Minute)))
+	is.True(!item.Due(now))
+	is.True(item.Due(now.Add(time.Minute)))
+}
+
+func TestStores(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		name     string
+		storeURL string
+	}{
+		{name: "memory", storeURL: "memory://"},
+		{name: "file", storeURL: "file://" + filepath.Join(dir, "files")},
+		{name: "sqlite", storeURL: "sqlite://" + filepath.Join(dir, "sessions.db")},
+	}
+
+	for _, tt := range tests {
+
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			store, err := outbox.NewStore(tt.storeURL)
+			if err != nil {
+				t.Fatalf("failed to create store: %s", err.Error())
+			}
+
+			// act + assert
+			testStore(t, store)
+		})
+	}
+}
+
+func TestNewStoreUnknownScheme(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// act
+	_, err := outbox.NewStore("redis://localhost")
+
+	// assert
+	is.True(err != nil)
+}
+
+func TestFileStoreSkipsBadItems(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	store, err := outbox.NewFileStore(dir)
+	is.NoErr(err)
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	item := outbox.NewItem("session-1", "https://example.com/", mf2.MicroFormat{}, now, now)
+	is.NoErr(store.Save(item))
+	is.NoErr(ioutil.WriteFile(filepath.Join(dir, "corrupt.json"), []byte(`{"id":`), 0600))
+
+	// act
+	result, err := outbox.ListForUser(store, "https://example.com/")
+
+	// assert
+	is.NoErr(err)
+	is.Equal(len(result), 1)
+	is.Equal(result[0].ID, item.ID)
+}
+
+// testStore checks the behaviour every Store must have
+func testStore(t *testing.T, store outbox.Store) {
+
+	is := is.NewRelaxed(t)
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	post := mf2.MicroFormat{
+		Type:       []string{"h-entry"},
+		Properties: map[string][]interface{}{"content": {"hello"}},
+	}
+	item := outbox.NewItem("session-1", "https://example.com/", post, now, now)
+
+	t.Run("fetching a missing item fails", func(t *testing.T) {
+		_, err := store.FetchByID("00000000-0000-0000-0000-000000000000")
+		is.True(err != nil)
+	})
+
+	t.Run("saved item can be fetched", func(t *testing.T) {
+		is.NoErr(store.Save(item))
+		result, err := store.FetchByID(item.ID)
+		is.NoErr(err)
+		is.Equal(result.ID, item.ID)
+		is.Equal(result.Me, item.Me)
+		is.Equal(result.Content(), "hello")
+		is.True(result.SendAt.Equal(item.SendAt))
+	})
+
+	t.Run("saving replaces an existing item", func(t *testing.T) {
+		updated := item
+		updated.Failed(errors.New("endpoint is down"), now)
+		is.NoErr(store.Save(updated))
+		result, err := store.FetchByID(item.ID)
+		is.NoErr(err)
+		is.Equal(result.Status, outbox.StatusPending)
+		is.Equal(result.LastError, "endpoint is down")
+	})
+
+	t.Run("items are listed", func(t *testing.T) {
+		other := outbox.NewItem("session-2", "https://other.example.com/", post, now, now)
+		is.NoErr(store.Save(other))
+		result, err := store.List()
+		is.NoErr(err)
+		is.Equal(len(result), 2)
+		mine, err := outbox.ListForUser(store, item.Me)
+		is.NoErr(err)
+		is.Equal(len(mine), 1)
+		is.Equal(mine[0].ID, item.ID)
+	})
+
+	t.Run("update changes the stored item", func(t *testing.T) {
+		result, err := store.Update(item.ID, func(item *outbox.Item) error {
+			return item.Claim(now)
+		})
+		is.NoErr(err)
+		is.Equal(result.Status, outbox.StatusSending)
+		result, err = store.FetchByID(item.ID)
+		is.NoErr(err)
+		is.True(result.Sending(now))
+	})
+
+	t.Run("failed update is not saved", func(t *testing.T) {
+		_, err := store.Update(item.ID, func(item *outbox.Item) error {
+			return item.Claim(now)
+		})
+		is.Equal(err, outbox.ErrSending)
+		result, err := store.FetchByID(item.ID)
+		is.NoErr(err)
+		is.Equal(result.Status, outbox.StatusSending)
+	})
+
+	t.Run("updating a missing item fails", func(t *testing.T) {
+		_, err := store.Update("00000000-0000-0000-0000-000000000000", func(item *outbox.Item) error {
+			return nil
+		})
+		is.True(err != nil)
+	})
+
+	t.Run("deleted item can not be fetched", func(t *testing.T) {
+		is.NoErr(store.Delete(item.ID))
+		_, err := store.FetchByID(item.ID)
+		is.True(err != nil)
+	})
+
+	t.Run("deleting a missing item is not an error", func(t *testing.T) {
+		is.NoErr(store.Delete(item.ID))
+	})
+}
@@ -0,0 +1,216 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// keySize is the size of AES-256 keys
+const keySize = 32
+
+// Keyring holds the keys used to encrypt sessions, new sessions are
+// encrypted with the primary key and older keys are kept so sessions
+// encrypted before a key rotation can still be read
+type Keyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+func NewKeyring(primary string, keys map[string][]byte) (Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return Keyring{}, fmt.Errorf("primary key %q not found", primary)
+	}
+	for id, key := range keys {
+		if len(key) != keySize {
+			return Keyring{}, fmt.Errorf("key %q must be %d bytes", id, keySize)
+		}
+	}
+	return Keyring{primary: primary, keys: keys}, nil
+}
+
+// ParseKeyring parses keys configured as a comma separated list of
+// id:base64key pairs, the first key is the primary key
+func ParseKeyring(config string) (Keyring, error) {
+	primary := ""
+	keys := make(map[string][]byte)
+	for _, pair := range strings.Split(config, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return Keyring{}, fmt.Errorf("keys must be id:base64key pairs")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return Keyring{}, fmt.Errorf("failed to decode key %q: %v", parts[0], err)
+		}
+		if primary == "" {
+			primary = parts[0]
+		}
+		keys[parts[0]] = key
+	}
+	return NewKeyring(primary, keys)
+}
+
+// SealedSession is an encrypted session, the session is encrypted with a
+// random data key which is itself encrypted with a key from the keyring
+type SealedSession struct {
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type encryptedSessionStore struct {
+	store SessionStore
+	keys  Keyring
+}
+
+// NewEncryptedSessionStore encrypts sessions before they are saved in
+// store, only the id and expiry are left readable so the store can still
+// find expired sessions
+func NewEncryptedSessionStore(store SessionStore, keys Keyring) SessionStore {
+	return encryptedSessionStore{store: store, keys: keys}
+}
+
+func (s encryptedSessionStore) Create(usess UserSession) error {
+	sealed, err := s.seal(usess)
+	if err != nil {
+		return err
+	}
+	return s.store.Create(sealed)
+}
+
+func (s encryptedSessionStore) FetchByID(sessionID string) (UserSession, error) {
+	sealed, err := s.store.FetchByID(sessionID)
+	if err != nil {
+		return sealed, err
+	}
+	return s.open(sealed)
+}
+
+func (s encryptedSessionStore) Delete(sessionID string) error {
+	return s.store.Delete(sessionID)
+}
+
+// FetchExpired returns sessions that can not be decrypted, for example
+// when their key was removed, with only their id so they are still swept
+func (s encryptedSessionStore) FetchExpired(now time.Time) ([]UserSession, error) {
+	sealed, err := s.store.FetchExpired(now)
+	if err != nil {
+		return nil, err
+	}
+	var expired []UserSession
+	for _, usess := range sealed {
+		opened, err := s.open(usess)
+		if err != nil {
+			log.Printf("failed to open expired session [%s][%s]", usess.Uid, err.Error())
+			opened = UserSession{Uid: usess.Uid, ExpiresAt: usess.ExpiresAt}
+		}
+		expired = append(expired, opened)
+	}
+	return expired, nil
+}
+
+func (s encryptedSessionStore) seal(usess UserSession) (UserSession, error) {
+	usess.Sealed = nil
+	data, err := json.Marshal(usess)
+	if err != nil {
+		return UserSession{}, fmt.Errorf("failed to encode json %v", err)
+	}
+
+	dataKey := make([]byte, keySize)
+	_, err = io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return UserSession{}, err
+	}
+
+	// the session id is authenticated so a sealed session can not be
+	// copied to another id
+	ciphertext, err := gcmSeal(dataKey, data, []byte(usess.Uid))
+	if err != nil {
+		return UserSession{}, err
+	}
+	wrappedKey, err := gcmSeal(s.keys.keys[s.keys.primary], dataKey, []byte(s.keys.primary))
+	if err != nil {
+		return UserSession{}, err
+	}
+
+	return UserSession{
+		Uid:       usess.Uid,
+		ExpiresAt: usess.ExpiresAt,
+		Sealed: &SealedSession{
+			KeyID:      s.keys.primary,
+			WrappedKey: wrappedKey,
+			Ciphertext: ciphertext,
+		},
+	}, nil
+}
+
+func (s encryptedSessionStore) open(sealed UserSession) (UserSession, error) {
+	// sessions saved before encryption was enabled are still readable
+	if sealed.Sealed == nil {
+		return sealed, nil
+	}
+
+	key, ok := s.keys.keys[sealed.Sealed.KeyID]
+	if !ok {
+		return UserSession{}, fmt.Errorf("session key %q not found", sealed.Sealed.KeyID)
+	}
+	dataKey, err := gcmOpen(key, sealed.Sealed.WrappedKey, []byte(sealed.Sealed.KeyID))
+	if err != nil {
+		return UserSession{}, fmt.Errorf("failed to unwrap session key: %v", err)
+	}
+	data, err := gcmOpen(dataKey, sealed.Sealed.Ciphertext, []byte(sealed.Uid))
+	if err != nil {
+		return UserSession{}, fmt.Errorf("failed to decrypt session: %v", err)
+	}
+
+	var usess UserSession
+	err = json.Unmarshal(data, &usess)
+	return usess, err
+}
+
+// gcmSeal encrypts plaintext with AES-GCM, the nonce is prepended to the
+// ciphertext
+func gcmSeal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func gcmOpen(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,195 @@
+package session_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
+	"github.com/matryer/is"
+)
+
+func newTestKeyring(t *testing.T, ids ...string) session.Keyring {
+	var pairs []string
+	for _, id := range ids {
+		// each id always gets the same key
+		key := bytes.Repeat([]byte{id[len(id)-1]}, 32)
+		pairs = append(pairs, id+":"+base64.StdEncoding.EncodeToString(key))
+	}
+	keys, err := session.ParseKeyring(strings.Join(pairs, ","))
+	if err != nil {
+		t.Fatalf("failed to parse keyring: %s", err.Error())
+	}
+	return keys
+}
+
+func TestEncryptedSessionStore(t *testing.T) {
+
+	// arrange
+	store := session.NewEncryptedSessionStore(
+		session.NewMemorySessionStore(),
+		newTestKeyring(t, "k1"),
+	)
+
+	// act + assert
+	testSessionStore(t, store)
+}
+
+func TestEncryptedSessionStoreHidesSession(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	inner := session.NewMemorySessionStore()
+	store := session.NewEncryptedSessionStore(inner, newTestKeyring(t, "k1"))
+	usess := session.UserSession{
+		Uid:         "b7c1e2f0-1d2a-4f1e-9c3b-2a1d0e9f8c7b",
+		Me:          "https://example.com/",
+		AccessToken: "secret-token",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+
+	// act
+	err := store.Create(usess)
+
+	// assert
+	is.NoErr(err)
+	stored, err := inner.FetchByID(usess.Uid)
+	is.NoErr(err)
+	is.Equal(stored.AccessToken, "")
+	is.Equal(stored.Me, "")
+	is.True(stored.Sealed != nil)
+	is.Equal(stored.Sealed.KeyID, "k1")
+}
+
+func TestEncryptedSessionStoreKeyRotation(t *testing.T) {
+
+	var tests = []struct {
+		name         string
+		readKeys     []string
+		expectsError bool
+	}{
+		{name: "same key", readKeys: []string{"k1"}},
+		{name: "rotated key keeps old key", readKeys: []string{"k2", "k1"}},
+		{name: "old key removed", readKeys: []string{"k2"}, expectsError: true},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// arrange
+			inner := session.NewMemorySessionStore()
+			writer := session.NewEncryptedSessionStore(inner, newTestKeyring(t, "k1"))
+			usess := session.UserSession{
+				Uid:         "b7c1e2f0-1d2a-4f1e-9c3b-2a1d0e9f8c7b",
+				AccessToken: "secret-token",
+				ExpiresAt:   time.Now().Add(time.Hour),
+			}
+			is.NoErr(writer.Create(usess))
+			reader := session.NewEncryptedSessionStore(inner, newTestKeyring(t, tt.readKeys...))
+
+			// act
+			result, err := reader.FetchByID(usess.Uid)
+
+			// assert
+			if tt.expectsError {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(result.AccessToken, "secret-token")
+		})
+	}
+}
+
+func TestEncryptedSessionStoreSweepsSessionsWithRemovedKeys(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	now := time.Now()
+	inner := session.NewMemorySessionStore()
+	writer := session.NewEncryptedSessionStore(inner, newTestKeyring(t, "k1"))
+	lost := session.UserSession{Uid: "lost", AccessToken: "secret-token", ExpiresAt: now.Add(-time.Hour)}
+	is.NoErr(writer.Create(lost))
+	reader := session.NewEncryptedSessionStore(inner, newTestKeyring(t, "k2"))
+	expired := session.UserSession{Uid: "expired", AccessToken: "other-token", ExpiresAt: now.Add(-time.Hour)}
+	is.NoErr(reader.Create(expired))
+
+	// act
+	result, err := reader.FetchExpired(now)
+
+	// assert
+	is.NoErr(err)
+	is.Equal(len(result), 2)
+	for _, usess := range result {
+		switch usess.Uid {
+		case lost.Uid:
+			is.Equal(usess.AccessToken, "")
+		case expired.Uid:
+			is.Equal(usess.AccessToken, "other-token")
+		default:
+			t.Errorf("unexpected session %s", usess.Uid)
+		}
+	}
+}
+
+func TestEncryptedSessionStoreReadsPlainSessions(t *testing.T) {
+
+	is := is.NewRelaxed(t)
+
+	// arrange
+	inner := session.NewMemorySessionStore()
+	usess := session.UserSession{
+		Uid:         "b7c1e2f0-1d2a-4f1e-9c3b-2a1d0e9f8c7b",
+		AccessToken: "plain-token",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+	is.NoErr(inner.Create(usess))
+	store := session.NewEncryptedSessionStore(inner, newTestKeyring(t, "k1"))
+
+	// act
+	result, err := store.FetchByID(usess.Uid)
+
+	// assert
+	is.NoErr(err)
+	is.Equal(result.AccessToken, "plain-token")
+}
+
+func TestParseKeyring(t *testing.T) {
+
+	validKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	shortKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16))
+
+	var tests = []struct {
+		name    string
+		config  string
+		isValid bool
+	}{
+		{name: "single key", config: "k1:" + validKey, isValid: true},
+		{name: "rotated keys", config: "k2:" + validKey + ",k1:" + validKey, isValid: true},
+		{name: "empty", config: "", isValid: false},
+		{name: "missing id", config: validKey, isValid: false},
+		{name: "short key", config: "k1:" + shortKey, isValid: false},
+		{name: "not base64", config: "k1:not-base64!", isValid: false},
+	}
+
+	for _, tt := range tests {
+
+		is := is.NewRelaxed(t)
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+
+			// act
+			_, err := session.ParseKeyring(tt.config)
+
+			// assert
+			is.Equal(err == nil, tt.isValid)
+		})
+	}
+}
@@ -2,20 +2,30 @@ package session
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/tomnomnom/linkheader"
-	"golang.org/x/net/html"
+	"github.com/j4y_funabashi/inari-admin/pkg/discovery"
+	_ "github.com/mattn/go-sqlite3"
 	"willnorris.com/go/microformats"
 
 	uuid "github.com/satori/go.uuid"
@@ -24,35 +34,187 @@ import (
 type SessionStore interface {
 	Create(usess UserSession) error
 	FetchByID(postID string) (UserSession, error)
+	Delete(sessionID string) error
+	FetchExpired(now time.Time) ([]UserSession, error)
 }
 
+// ErrSessionExpired is returned when fetching a session that has expired
+var ErrSessionExpired = errors.New("session expired")
+
+// ErrTokenRevoked is returned when the access token of a session can no
+// longer be used and the user has to log in again
+var ErrTokenRevoked = errors.New("access token revoked")
+
+const (
+	// LoginTimeout is how long a user has to complete a login
+	LoginTimeout = time.Hour
+	// SessionLifetime is how long a user stays logged in
+	SessionLifetime = 30 * 24 * time.Hour
+)
+
 type UserSession struct {
-	Uid                   string       `json:"uid"`
-	Me                    string       `json:"me"`
-	ClientId              string       `json:"client_id"`
-	RedirectUri           string       `json:"redirect_uri"`
-	Scope                 string       `json:"scope"`
-	State                 string       `json:"state"`
-	AuthorizationEndpoint string       `json:"authorization_endpoint"`
-	TokenEndpoint         string       `json:"token_endpoint"`
-	MicropubEndpoint      string       `json:"micropub_endpoint"`
-	MediaEndpoint         string       `json:"media_endpoint"`
-	AccessToken           string       `json:"access_token"`
-	TokenType             string       `json:"token_type"`
-	ComposerData          ComposerData `json:"composer_data"`
-	HCard                 HCard        `json:"h_card"`
+	Uid                   string              `json:"uid"`
+	Me                    string              `json:"me"`
+	ClientId              string              `json:"client_id"`
+	RedirectUri           string              `json:"redirect_uri"`
+	Scope                 string              `json:"scope"`
+	State                 string              `json:"state"`
+	CodeVerifier          string              `json:"code_verifier,omitempty"`
+	Issuer                string              `json:"issuer"`
+	AuthorizationEndpoint string              `json:"authorization_endpoint"`
+	TokenEndpoint         string              `json:"token_endpoint"`
+	IntrospectionEndpoint string              `json:"introspection_endpoint"`
+	MicropubEndpoint      string              `json:"micropub_endpoint"`
+	MediaEndpoint         string              `json:"media_endpoint"`
+	MicrosubEndpoint      string              `json:"microsub_endpoint,omitempty"`
+	AccessToken           string              `json:"access_token"`
+	TokenType             string              `json:"token_type"`
+	RefreshToken          string              `json:"refresh_token,omitempty"`
+	TokenExpiresAt        time.Time           `json:"token_expires_at"`
+	TokenCheckedAt        time.Time           `json:"token_checked_at"`
+	ComposerData          ComposerData        `json:"composer_data"`
+	HCard                 HCard               `json:"h_card"`
+	HCardFetchedAt        time.Time           `json:"h_card_fetched_at"`
+	Categories            []string            `json:"categories"`
+	CategoriesFetchedAt   time.Time           `json:"categories_fetched_at"`
+	SyndicateTo           []SyndicationTarget `json:"syndicate_to"`
+	Flash                 string              `json:"flash"`
+	ExpiresAt             time.Time           `json:"expires_at"`
+	Sealed                *SealedSession      `json:"sealed,omitempty"`
+	CSRFToken             string              `json:"csrf_token"`
+	ReturnTo              string              `json:"return_to,omitempty"`
+	// OtherAccounts are the other sites this browser is logged in to, they
+	// are looked up on each request and never saved
+	OtherAccounts []Account `json:"-"`
 }
 
+// categoriesTTL is how long the micropub category list is cached in the
+// session
+const categoriesTTL = time.Hour
+
+// hcardTTL is how long the h-card of the profile page is cached in the
+// session
+const hcardTTL = 24 * time.Hour
+
 type MediaUpload struct {
 	URL       string   `json:"url"`
+	Alt       string   `json:"alt"`
 	Published string   `json:"published"`
 	Location  Location `json:"location"`
 }
 
 type ComposerData struct {
-	Photos    []MediaUpload `json:"photos"`
-	Published string
-	Location  Location
+	PostType      string        `json:"post_type"`
+	Photos        []MediaUpload `json:"photos"`
+	Published     string
+	Location      Location
+	Name          string   `json:"name"`
+	Content       string   `json:"content"`
+	ContentFormat string   `json:"content_format"`
+	InReplyTo     string   `json:"in_reply_to"`
+	LikeOf        string   `json:"like_of"`
+	BookmarkOf    string   `json:"bookmark_of"`
+	RepostOf      string   `json:"repost_of"`
+	Rsvp          string   `json:"rsvp"`
+	Category      []string `json:"category"`
+	SyndicateTo   []string `json:"syndicate_to"`
+	PostStatus    string   `json:"post_status"`
+}
+
+const (
+	PostTypeNote     = "note"
+	PostTypeArticle  = "article"
+	PostTypeReply    = "reply"
+	PostTypeLike     = "like"
+	PostTypeBookmark = "bookmark"
+	PostTypeRepost   = "repost"
+	PostTypeRsvp     = "rsvp"
+	PostTypeCheckin  = "checkin"
+
+	ContentFormatMarkdown = "markdown"
+	ContentFormatHTML     = "html"
+
+	PostStatusDraft     = "draft"
+	PostStatusPublished = "published"
+)
+
+// PostTypes lists the post types the composer can create
+var PostTypes = []string{
+	PostTypeNote,
+	PostTypeArticle,
+	PostTypeReply,
+	PostTypeLike,
+	PostTypeBookmark,
+	PostTypeRepost,
+	PostTypeRsvp,
+	PostTypeCheckin,
+}
+
+// RsvpValues are the allowed values of an rsvp post
+var RsvpValues = []string{"yes", "no", "maybe", "interested"}
+
+// Type returns the composer post type, defaulting to a note
+func (cd ComposerData) Type() string {
+	if sliceContains(PostTypes, cd.PostType) {
+		return strings.ToLower(cd.PostType)
+	}
+	return PostTypeNote
+}
+
+// PublishedTime parses the published date of the post
+func (cd ComposerData) PublishedTime() (time.Time, error) {
+	return time.Parse(time.RFC3339, cd.Published)
+}
+
+// Validate checks the composer has the fields required by its post
+// type
+func (cd ComposerData) Validate() error {
+	switch cd.Type() {
+	case PostTypeNote:
+		if strings.TrimSpace(cd.Content) == "" && len(cd.Photos) == 0 {
+			return fmt.Errorf("a note needs some content or a photo")
+		}
+	case PostTypeArticle:
+		if strings.TrimSpace(cd.Name) == "" {
+			return fmt.Errorf("an article needs a title")
+		}
+		if strings.TrimSpace(cd.Content) == "" {
+			return fmt.Errorf("an article needs some content")
+		}
+	case PostTypeReply:
+		if err := validateURL("in-reply-to", cd.InReplyTo); err != nil {
+			return err
+		}
+		if strings.TrimSpace(cd.Content) == "" {
+			return fmt.Errorf("a reply needs some content")
+		}
+	case PostTypeLike:
+		return validateURL("like-of", cd.LikeOf)
+	case PostTypeBookmark:
+		return validateURL("bookmark-of", cd.BookmarkOf)
+	case PostTypeRepost:
+		return validateURL("repost-of", cd.RepostOf)
+	case PostTypeRsvp:
+		if err := validateURL("in-reply-to", cd.InReplyTo); err != nil {
+			return err
+		}
+		if !sliceContains(RsvpValues, cd.Rsvp) {
+			return fmt.Errorf("rsvp must be one of %s", strings.Join(RsvpValues, ", "))
+		}
+	case PostTypeCheckin:
+		if !cd.Location.HasLatLng() {
+			return fmt.Errorf("a check-in needs a location")
+		}
+	}
+	return nil
+}
+
+func validateURL(property, value string) error {
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("%s must be a valid URL", property)
+	}
+	return nil
 }
 
 type Location struct {
@@ -70,6 +232,12 @@ func (loc Location) HasLatLng() bool {
 	return false
 }
 
+// HasAddress returns true if the location has been geocoded to a named
+// place
+func (loc Location) HasAddress() bool {
+	return loc.Locality != "" || loc.Region != "" || loc.Country != ""
+}
+
 func (loc Location) ToGeoURL() string {
 	return fmt.Sprintf("geo:%v,%v", loc.Lat, loc.Lng)
 }
@@ -101,10 +269,193 @@ func (usess *UserSession) AddPhotoUpload(url, pub string, loc Location) {
 	}
 }
 
+func (usess *UserSession) AddCategory(category string) {
+	category = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(category), "#"))
+	if category == "" || sliceContains(usess.ComposerData.Category, category) {
+		return
+	}
+	usess.ComposerData.Category = append(usess.ComposerData.Category, category)
+}
+
+func (usess *UserSession) RemoveCategory(category string) {
+	categories := []string{}
+	for _, c := range usess.ComposerData.Category {
+		if c != category {
+			categories = append(categories, c)
+		}
+	}
+	usess.ComposerData.Category = categories
+}
+
+// CategoriesExpired returns true if the cached category list needs to be
+// fetched again
+func (usess UserSession) CategoriesExpired(now time.Time) bool {
+	return usess.CategoriesFetchedAt.IsZero() || now.Sub(usess.CategoriesFetchedAt) > categoriesTTL
+}
+
+func (usess *UserSession) SetCategories(categories []string, now time.Time) {
+	usess.Categories = categories
+	usess.CategoriesFetchedAt = now
+}
+
+// SuggestCategories returns cached categories starting with prefix that
+// have not already been added to the composer
+func (usess UserSession) SuggestCategories(prefix string, limit int) []string {
+	prefix = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(prefix, "#")))
+	out := []string{}
+	for _, c := range usess.Categories {
+		if len(out) >= limit {
+			break
+		}
+		if !strings.HasPrefix(strings.ToLower(c), prefix) {
+			continue
+		}
+		if sliceContains(usess.ComposerData.Category, c) {
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// SetPostType switches the composer to postType, unknown types are
+// ignored
+func (usess *UserSession) SetPostType(postType string) {
+	if sliceContains(PostTypes, postType) {
+		usess.ComposerData.PostType = strings.ToLower(postType)
+	}
+}
+
+// PopFlash returns the flash message and removes it from the session
+func (usess *UserSession) PopFlash() string {
+	flash := usess.Flash
+	usess.Flash = ""
+	return flash
+}
+
 func (usess *UserSession) ClearComposerData() {
 	usess.ComposerData = ComposerData{}
 }
 
+// Scopes are the scopes a user can ask for when logging in
+var Scopes = []string{"create", "update", "delete", "media", "draft", "read"}
+
+// DefaultScope is asked for when no scopes were chosen
+const DefaultScope = "create"
+
+// ParseScope turns the chosen scopes into a space separated scope,
+// unknown and repeated scopes are dropped
+func ParseScope(chosen []string) string {
+	var scopes []string
+	for _, scope := range Scopes {
+		if sliceContains(chosen, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return DefaultScope
+	}
+	return strings.Join(scopes, " ")
+}
+
+// HasScope is true when the access token was granted scope, the older post
+// scope is the same as create
+func (usess UserSession) HasScope(scope string) bool {
+	for _, granted := range strings.Fields(usess.Scope) {
+		if granted == "post" {
+			granted = "create"
+		}
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions are the actions the access token allows, used to hide
+// actions that would be rejected by the micropub endpoint
+type Permissions struct {
+	Create bool
+	Draft  bool
+	Update bool
+	Delete bool
+	Media  bool
+}
+
+func (usess UserSession) Permissions() Permissions {
+	return Permissions{
+		Create: usess.HasScope("create"),
+		Draft:  usess.HasScope("create") || usess.HasScope("draft"),
+		Update: usess.HasScope("update"),
+		Delete: usess.HasScope("delete"),
+		Media:  usess.HasScope("media"),
+	}
+}
+
+// Account is a site a browser is logged in to
+type Account struct {
+	Me    string
+	Name  string
+	Photo string
+}
+
+// Host is the site of the account without the scheme
+func (acc Account) Host() string {
+	host := strings.TrimPrefix(strings.TrimPrefix(acc.Me, "https://"), "http://")
+	return strings.TrimSuffix(host, "/")
+}
+
+// Accounts are the sites a browser is logged in to, Current is the site new
+// posts are sent to
+type Accounts struct {
+	Current Account
+	Others  []Account
+}
+
+func (usess UserSession) Account() Account {
+	name := usess.HCard.Name
+	if name == "" {
+		name = usess.HCard.Nickname
+	}
+	return Account{
+		Me:    usess.Me,
+		Name:  name,
+		Photo: usess.HCard.Photo,
+	}
+}
+
+func (usess UserSession) Accounts() Accounts {
+	return Accounts{Current: usess.Account(), Others: usess.OtherAccounts}
+}
+
+// FetchAccounts returns the logged in sessions of sessionIDs in the same
+// order, sessions that expired or never finished logging in are left out
+func FetchAccounts(store SessionStore, sessionIDs []string) []UserSession {
+	var sessions []UserSession
+	for _, sessionID := range sessionIDs {
+		usess, err := store.FetchByID(sessionID)
+		if err != nil || usess.AccessToken == "" {
+			continue
+		}
+		sessions = append(sessions, usess)
+	}
+	return sessions
+}
+
+// AccountIDs returns the ids of sessions and when the last of them expires,
+// used to write the cookie of a browser logged in to several sites
+func AccountIDs(sessions []UserSession) ([]string, time.Time) {
+	var ids []string
+	var expiresAt time.Time
+	for _, usess := range sessions {
+		ids = append(ids, usess.Uid)
+		if usess.ExpiresAt.After(expiresAt) {
+			expiresAt = usess.ExpiresAt
+		}
+	}
+	return ids, expiresAt
+}
+
 func NewUserSession(me, clientId, redirectUri string) (UserSession, error) {
 	p := UserSession{}
 	uid := uuid.NewV4()
@@ -112,11 +463,95 @@ func NewUserSession(me, clientId, redirectUri string) (UserSession, error) {
 	p.Me = me
 	p.ClientId = clientId
 	p.RedirectUri = redirectUri
-	p.Scope = "create"
+	p.Scope = DefaultScope
 	p.State = uid.String()
+	p.ExpiresAt = time.Now().Add(LoginTimeout)
+	verifier, err := newSessionID()
+	if err != nil {
+		return p, err
+	}
+	p.CodeVerifier = verifier
 	return p, nil
 }
 
+// Rotate gives the session a new random id once the user has logged in,
+// so the state sent to the authorization endpoint is never a session id
+func (usess *UserSession) Rotate() error {
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	usess.Uid = id
+	usess.State = ""
+	usess.CodeVerifier = ""
+	return usess.NewCSRFToken()
+}
+
+// NewCSRFToken gives the session a new token that must be sent with every
+// form posted by the user
+func (usess *UserSession) NewCSRFToken() error {
+	token, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	usess.CSRFToken = token
+	return nil
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate session id: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Expired is true when the session can no longer be used, sessions
+// without an expiry date are expired
+func (usess UserSession) Expired(now time.Time) bool {
+	return !usess.ExpiresAt.After(now)
+}
+
+// Extend keeps the session alive for SessionLifetime from now
+func (usess *UserSession) Extend(now time.Time) {
+	usess.ExpiresAt = now.Add(SessionLifetime)
+}
+
+// SetToken stores a token issued by the token endpoint, expiresIn is in
+// seconds and 0 for tokens that do not expire
+func (usess *UserSession) SetToken(accessToken, refreshToken, scope string, expiresIn int, now time.Time) {
+	usess.AccessToken = accessToken
+	if refreshToken != "" {
+		usess.RefreshToken = refreshToken
+	}
+	if scope != "" {
+		usess.Scope = scope
+	}
+	usess.TokenExpiresAt = time.Time{}
+	if expiresIn > 0 {
+		usess.TokenExpiresAt = now.Add(time.Duration(expiresIn) * time.Second)
+	}
+	usess.TokenCheckedAt = now
+}
+
+// TokenExpiresSoon is true when the access token expires within margin of
+// now
+func (usess UserSession) TokenExpiresSoon(now time.Time, margin time.Duration) bool {
+	if usess.TokenExpiresAt.IsZero() {
+		return false
+	}
+	return !now.Add(margin).Before(usess.TokenExpiresAt)
+}
+
+// checkExpiry returns ErrSessionExpired for expired sessions
+func checkExpiry(usess UserSession) (UserSession, error) {
+	if usess.Expired(time.Now()) {
+		return UserSession{}, ErrSessionExpired
+	}
+	return usess, nil
+}
+
 func (params *UserSession) BuildAuthRedirectUrl() (string, error) {
 	authUrl, err := url.Parse(params.AuthorizationEndpoint)
 	if err != nil {
@@ -129,105 +564,329 @@ func (params *UserSession) BuildAuthRedirectUrl() (string, error) {
 	q.Set("state", params.State)
 	q.Set("scope", params.Scope)
 	q.Set("response_type", "code")
+	q.Set("code_challenge", CodeChallenge(params.CodeVerifier))
+	q.Set("code_challenge_method", "S256")
 	authUrl.RawQuery = q.Encode()
 	return authUrl.String(), nil
 }
 
-func (usess *UserSession) DiscoverEndpoints() error {
+// CodeChallenge is the S256 PKCE challenge for verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
 
-	// fetch and parse me url
-	resp, err := http.Get(usess.Me)
+// IndieAuthMetadata is the authorization server metadata published at the
+// indieauth-metadata endpoint
+type IndieAuthMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+}
+
+func fetchIndieAuthMetadata(metadataURL string) (IndieAuthMetadata, error) {
+	metadata := IndieAuthMetadata{}
+
+	req, err := http.NewRequest("GET", metadataURL, nil)
 	if err != nil {
-		log.Printf("failed to GET [%s][%s]", usess.Me, err.Error())
-		return err
+		return metadata, err
 	}
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return metadata, err
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("URL returned a non-200: [%s][%d]", usess.Me, resp.StatusCode)
-		return fmt.Errorf("URL returned a non-200")
+		return metadata, fmt.Errorf("metadata endpoint returned a non-200: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return metadata, err
+	}
+	err = json.Unmarshal(body, &metadata)
+	if err != nil {
+		return metadata, fmt.Errorf("failed to decode metadata: %v", err)
+	}
+
+	// the issuer must be a prefix of the metadata url so a server can not
+	// claim to be another issuer
+	issuer, err := url.Parse(metadata.Issuer)
+	if err != nil || issuer.Host == "" || !strings.HasPrefix(metadataURL, metadata.Issuer) {
+		return metadata, fmt.Errorf("invalid issuer %q for metadata %s", metadata.Issuer, metadataURL)
+	}
+	if issuer.RawQuery != "" || issuer.Fragment != "" {
+		return metadata, fmt.Errorf("issuer %q must not have a query or fragment", metadata.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" {
+		return metadata, fmt.Errorf("metadata is missing the authorization or token endpoint")
+	}
+	return metadata, nil
+}
+
+// CanonicalizeMe turns the profile url entered by a user into the form
+// used by IndieAuth, a missing scheme defaults to https and an empty path
+// becomes /
+func CanonicalizeMe(me string) (string, error) {
+	me = strings.TrimSpace(me)
+	if me == "" {
+		return "", fmt.Errorf("enter the url of your website")
+	}
+	if !strings.Contains(me, "://") {
+		me = "https://" + me
+	}
+
+	u, err := url.Parse(me)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a valid url", me)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%q must be an http or https url", me)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("%q has no host", me)
+	}
+	if net.ParseIP(u.Hostname()) != nil {
+		return "", fmt.Errorf("%q must use a domain name, not an ip address", me)
 	}
-	doc, err := html.Parse(resp.Body)
+	if u.Port() != "" {
+		return "", fmt.Errorf("%q must not contain a port", me)
+	}
+	if u.User != nil {
+		return "", fmt.Errorf("%q must not contain a username or password", me)
+	}
+	if u.Fragment != "" {
+		return "", fmt.Errorf("%q must not contain a fragment", me)
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return "", fmt.Errorf("%q must not contain . or .. path segments", me)
+		}
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String(), nil
+}
+
+// DiscoverEndpoints fetches the profile page of the session and finds the
+// endpoints it links to
+func (usess *UserSession) DiscoverEndpoints() error {
+
+	// fetch and parse me url
+	profile, err := discovery.Fetch(&http.Client{}, usess.Me)
 	if err != nil {
-		log.Printf("failed to parse HTML [%s][%s]", usess.Me, err.Error())
-		return fmt.Errorf("failed to parse HTML [%s][%s]", usess.Me, err.Error())
+		log.Printf("failed to fetch profile [%s][%s]", usess.Me, err.Error())
+		return err
 	}
+	usess.Me = profile.Me
 
-	// find auth, token and micropub endpoints
-	usess.AuthorizationEndpoint = findEndpoint(doc, "authorization_endpoint", resp.Header)
+	// find auth and token endpoints, servers publishing metadata are
+	// preferred over the older link rels
+	metadataURL := profile.Endpoint(discovery.RelIndieAuthMetadata)
+	if metadataURL != "" {
+		metadata, err := fetchIndieAuthMetadata(metadataURL)
+		if err != nil {
+			return fmt.Errorf("failed to fetch indieauth metadata: %v", err)
+		}
+		usess.Issuer = metadata.Issuer
+		usess.AuthorizationEndpoint = metadata.AuthorizationEndpoint
+		usess.TokenEndpoint = metadata.TokenEndpoint
+		usess.IntrospectionEndpoint = metadata.IntrospectionEndpoint
+	} else {
+		usess.AuthorizationEndpoint = profile.Endpoint(discovery.RelAuthorizationEndpoint)
+		usess.TokenEndpoint = profile.Endpoint(discovery.RelTokenEndpoint)
+	}
 	if usess.AuthorizationEndpoint == "" {
 		return fmt.Errorf("failed to find authorization_endpoint")
 	}
-	usess.TokenEndpoint = findEndpoint(doc, "token_endpoint", resp.Header)
-	usess.MicropubEndpoint = findEndpoint(doc, "micropub", resp.Header)
+	usess.MicropubEndpoint = profile.Endpoint(discovery.RelMicropub)
+	usess.MicrosubEndpoint = profile.Endpoint(discovery.RelMicrosub)
 
-	// try to find h-card
-	usess.HCard = discoverHcard(usess.Me)
+	// the h-card is read from the page that was already fetched
+	usess.SetHCard(discoverHcard(profile), time.Now())
 
 	return nil
 }
 
+// VerifyMe checks the profile url returned by the token endpoint, a
+// different url is only accepted if it uses the same authorization server
+// as the url the user logged in with. The returned session holds the
+// endpoints and h-card of the profile that was verified
+func (usess UserSession) VerifyMe(returnedMe string) (UserSession, error) {
+	me, err := CanonicalizeMe(returnedMe)
+	if err != nil {
+		return UserSession{}, err
+	}
+	if me == usess.Me {
+		return usess, nil
+	}
+
+	other := UserSession{Me: me}
+	err = other.DiscoverEndpoints()
+	if err != nil {
+		return UserSession{}, fmt.Errorf("failed to discover endpoints for %s: %v", me, err)
+	}
+	if other.AuthorizationEndpoint != usess.AuthorizationEndpoint || other.Issuer != usess.Issuer {
+		return UserSession{}, fmt.Errorf("%s does not use the authorization server of %s", me, usess.Me)
+	}
+	return other, nil
+}
+
+// SetProfile copies the profile url, endpoints and h-card of profile so
+// the session posts to the site that was verified
+func (usess *UserSession) SetProfile(profile UserSession) {
+	usess.Me = profile.Me
+	usess.TokenEndpoint = profile.TokenEndpoint
+	usess.IntrospectionEndpoint = profile.IntrospectionEndpoint
+	usess.MicropubEndpoint = profile.MicropubEndpoint
+	usess.MicrosubEndpoint = profile.MicrosubEndpoint
+	usess.SetHCard(profile.HCard, profile.HCardFetchedAt)
+}
+
 type HCard struct {
-	Name  string `json:"name"`
-	URL   string `json:"url"`
-	Photo string `json:"photo"`
+	Name     string `json:"name"`
+	Nickname string `json:"nickname,omitempty"`
+	URL      string `json:"url"`
+	Photo    string `json:"photo"`
+	Note     string `json:"note,omitempty"`
+	Email    string `json:"email,omitempty"`
 }
 
-func discoverHcard(meURL string) HCard {
-	resp, err := http.Get(meURL)
+// discoverHcard parses the representative h-card of a profile page that
+// was already fetched
+func discoverHcard(profile discovery.Profile) HCard {
+	pURL, err := url.Parse(profile.URL)
 	if err != nil {
-		log.Printf("failed to GET [%s][%s]", meURL, err.Error())
+		log.Printf("failed to parse URL [%s]", err.Error())
 		return HCard{}
 	}
-	pURL, err := url.Parse(meURL)
-	if err != nil {
-		log.Printf("failed to parse URL [%s]", err.Error())
+	mf := microformats.Parse(bytes.NewReader(profile.Body), pURL)
+	return ParseHCard(mf, profile.URL)
+}
+
+// ParseHCard returns the representative h-card of the page at pageURL,
+// following http://microformats.org/wiki/representative-h-card-parsing
+func ParseHCard(mf *microformats.Data, pageURL string) HCard {
+	item := representativeHcard(mf, pageURL)
+	if item == nil {
 		return HCard{}
 	}
-	mf := microformats.Parse(resp.Body, pURL)
-	log.Printf("mf2: %+v", mf)
+	return HCard{
+		Name:     mfGetFirstString(item.Properties["name"]),
+		Nickname: mfGetFirstString(item.Properties["nickname"]),
+		URL:      mfGetFirstString(item.Properties["url"]),
+		Photo:    mfGetFirstString(item.Properties["photo"]),
+		Note:     mfGetFirstString(item.Properties["note"]),
+		Email:    strings.TrimPrefix(mfGetFirstString(item.Properties["email"]), "mailto:"),
+	}
+}
+
+func representativeHcard(mf *microformats.Data, pageURL string) *microformats.Microformat {
+	var hcards []*microformats.Microformat
 	for _, item := range mf.Items {
 		if sliceContains(item.Type, "h-card") {
-			if isRepresentativeHcard(item, meURL) {
-				return HCard{
-					Name:  mfGetFirstString(item.Properties["name"]),
-					URL:   mfGetFirstString(item.Properties["url"]),
-					Photo: mfGetFirstString(item.Properties["photo"]),
-				}
-			}
+			hcards = append(hcards, item)
 		}
 	}
-	return HCard{}
-}
 
-func isRepresentativeHcard(mf *microformats.Microformat, meURL string) bool {
-	if mfSliceContains(mf.Properties["url"], meURL) == false {
-		return false
+	// an h-card with a uid and url of the page
+	for _, item := range hcards {
+		if mfContainsURL(item.Properties["uid"], pageURL) && mfContainsURL(item.Properties["url"], pageURL) {
+			return item
+		}
 	}
-	if mfSliceContains(mf.Properties["uid"], meURL) == false {
-		return false
+
+	// an h-card with a url that is also a rel=me link of the page
+	for _, item := range hcards {
+		for _, me := range mf.Rels["me"] {
+			if mfContainsURL(item.Properties["url"], me) {
+				return item
+			}
+		}
 	}
-	return true
+
+	// the only h-card on the page, with a url of the page
+	if len(hcards) == 1 && mfContainsURL(hcards[0].Properties["url"], pageURL) {
+		return hcards[0]
+	}
+	return nil
 }
 
+// mfGetFirstString returns the first value of property, the value of
+// embedded microformats and images with alt text is used
 func mfGetFirstString(property []interface{}) string {
 	for _, val := range property {
-		if v, ok := val.(string); ok == true {
+		switch v := val.(type) {
+		case string:
 			return v
+		case map[string]string:
+			return v["value"]
+		case *microformats.Microformat:
+			return v.Value
 		}
 	}
 	return ""
 }
 
-func mfSliceContains(property []interface{}, value string) bool {
+// mfContainsURL is true if one of the values of property is the same url
+// as value
+func mfContainsURL(property []interface{}, value string) bool {
 	for _, val := range property {
-		if v, ok := val.(string); ok == true {
-			if v == value {
-				return true
-			}
+		if v, ok := val.(string); ok && sameURL(v, value) {
+			return true
 		}
 	}
 	return false
 }
 
+// sameURL compares urls ignoring the case of the scheme and host and an
+// empty path
+func sameURL(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	for _, u := range []*url.URL{ua, ub} {
+		u.Scheme = strings.ToLower(u.Scheme)
+		u.Host = strings.ToLower(u.Host)
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+	return ua.String() == ub.String()
+}
+
+// HCardExpired returns true if the cached h-card needs to be fetched again
+func (usess UserSession) HCardExpired(now time.Time) bool {
+	return usess.HCardFetchedAt.IsZero() || now.Sub(usess.HCardFetchedAt) > hcardTTL
+}
+
+func (usess *UserSession) SetHCard(hcard HCard, now time.Time) {
+	usess.HCard = hcard
+	usess.HCardFetchedAt = now
+}
+
+// RefreshHCard fetches the profile page again to update the cached h-card
+func (usess *UserSession) RefreshHCard(now time.Time) error {
+	profile, err := discovery.Fetch(&http.Client{}, usess.Me)
+	if err != nil {
+		return fmt.Errorf("failed to fetch profile: %v", err)
+	}
+	usess.SetHCard(discoverHcard(profile), now)
+	return nil
+}
+
 func sliceContains(slice []string, value string) bool {
 	for _, v := range slice {
 		if strings.ToLower(v) == strings.ToLower(value) {
@@ -237,8 +896,11 @@ func sliceContains(slice []string, value string) bool {
 	return false
 }
 
-func (usess *UserSession) DiscoverMediaEndpoint() {
+// DiscoverMicropubConfig queries the micropub endpoint config for the
+// media endpoint and syndication targets
+func (usess *UserSession) DiscoverMicropubConfig() {
 	usess.MediaEndpoint = ""
+	usess.SyndicateTo = nil
 	if usess.MicropubEndpoint == "" {
 		return
 	}
@@ -252,6 +914,7 @@ func (usess *UserSession) DiscoverMediaEndpoint() {
 		return
 	}
 	usess.MediaEndpoint = config.MediaEndpoint
+	usess.SyndicateTo = config.SyndicateTo
 }
 
 func buildConfigUrl(micropubEndpoint string) (string, error) {
@@ -266,7 +929,15 @@ func buildConfigUrl(micropubEndpoint string) (string, error) {
 }
 
 type MicropubConfig struct {
-	MediaEndpoint string `json:"media-endpoint"`
+	MediaEndpoint string              `json:"media-endpoint"`
+	SyndicateTo   []SyndicationTarget `json:"syndicate-to"`
+}
+
+// SyndicationTarget is a service the micropub server can syndicate posts
+// to
+type SyndicationTarget struct {
+	UID  string `json:"uid"`
+	Name string `json:"name"`
 }
 
 func fetchMicropubConfig(configUrl, accessToken string) (MicropubConfig, error) {
@@ -296,42 +967,8 @@ func fetchMicropubConfig(configUrl, accessToken string) (MicropubConfig, error)
 	return config, nil
 }
 
-func findEndpoint(n *html.Node, endpoint string, head http.Header) (out string) {
-	if head.Get("Link") != "" {
-		for k, v := range head {
-			if strings.TrimSpace(strings.ToLower(k)) == "link" {
-				for _, v2 := range v {
-					for _, link := range linkheader.Parse(v2) {
-						if link.Rel == endpoint {
-							return link.URL
-						}
-					}
-				}
-			}
-		}
-		return ""
-	}
-	if n.Type == html.ElementNode && n.Data == "link" {
-		for _, a := range n.Attr {
-			if a.Key == "rel" && a.Val == endpoint {
-				for _, b := range n.Attr {
-					if b.Key == "href" {
-						return b.Val
-					}
-				}
-			}
-		}
-	}
-	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		out = findEndpoint(c, endpoint, head)
-		if out != "" {
-			return out
-		}
-	}
-	return out
-}
-
 type s3SessionStore struct {
+	client     *s3.S3
 	downloader *s3manager.Downloader
 	uploader   *s3manager.Uploader
 	bucket     string
@@ -371,8 +1008,71 @@ func (s s3SessionStore) FetchByID(sessionID string) (UserSession, error) {
 	}
 
 	err = json.Unmarshal(buf.Bytes(), &sess)
+	if err != nil {
+		return sess, err
+	}
+
+	return checkExpiry(sess)
+}
 
-	return sess, nil
+func (s s3SessionStore) Delete(sessionID string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String("sessions/" + sessionID + ".json"),
+	})
+	return err
+}
+
+func (s s3SessionStore) FetchExpired(now time.Time) ([]UserSession, error) {
+	return s.filter(func(sess UserSession) bool {
+		return sess.Expired(now)
+	})
+}
+
+// filter downloads every session in the bucket and returns those matching
+// keep, so each sweep costs a list and a GET for every session. Sessions
+// that can not be read are logged and skipped so one bad object does not
+// stop the sweep
+func (s s3SessionStore) filter(keep func(UserSession) bool) ([]UserSession, error) {
+	var keys []string
+	err := s.client.ListObjectsV2Pages(
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String("sessions/"),
+		},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				keys = append(keys, *obj.Key)
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []UserSession
+	for _, key := range keys {
+		var sess UserSession
+		buf := aws.NewWriteAtBuffer([]byte{})
+		_, err := s.downloader.Download(buf, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			log.Printf("failed to download session [%s][%s]", key, err.Error())
+			continue
+		}
+		err = json.Unmarshal(buf.Bytes(), &sess)
+		if err != nil {
+			log.Printf("failed to decode session [%s][%s]", key, err.Error())
+			continue
+		}
+		if keep(sess) {
+			out = append(out, sess)
+		}
+	}
+	return out, nil
 }
 
 func NewS3SessionStore(region, bucket string) (SessionStore, error) {
@@ -384,5 +1084,309 @@ func NewS3SessionStore(region, bucket string) (SessionStore, error) {
 	}
 	downloader := s3manager.NewDownloader(sess)
 	uploader := s3manager.NewUploader(sess)
-	return s3SessionStore{downloader: downloader, uploader: uploader, bucket: bucket}, nil
+	return s3SessionStore{client: s3.New(sess), downloader: downloader, uploader: uploader, bucket: bucket}, nil
+}
+
+// NewSessionStore creates a session store from a URL, the scheme picks the
+// backend:
+//
+//	s3://bucket?region=eu-central-1
+//	file:///var/lib/inari-admin/sessions
+//	sqlite:///var/lib/inari-admin/sessions.db
+//	memory://
+func NewSessionStore(storeURL string) (SessionStore, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse session store url: %v", err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		region := u.Query().Get("region")
+		if region == "" {
+			region = "eu-central-1"
+		}
+		return NewS3SessionStore(region, u.Host)
+	case "file":
+		return NewFileSessionStore(u.Host + u.Path)
+	case "sqlite":
+		return NewSQLiteSessionStore(u.Host + u.Path)
+	case "memory":
+		return NewMemorySessionStore(), nil
+	}
+	return nil, fmt.Errorf("unknown session store %q", u.Scheme)
+}
+
+type memorySessionStore struct {
+	mu       *sync.Mutex
+	sessions map[string][]byte
+}
+
+// NewMemorySessionStore keeps sessions in memory, they are lost on
+// restart
+func NewMemorySessionStore() SessionStore {
+	return memorySessionStore{
+		mu:       &sync.Mutex{},
+		sessions: make(map[string][]byte),
+	}
+}
+
+func (s memorySessionStore) Create(usess UserSession) error {
+	// store json so callers never share slices with the store
+	data, err := json.Marshal(usess)
+	if err != nil {
+		return fmt.Errorf("failed to encode json %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[usess.Uid] = data
+	return nil
+}
+
+func (s memorySessionStore) FetchByID(sessionID string) (UserSession, error) {
+	var sess UserSession
+	s.mu.Lock()
+	data, ok := s.sessions[sessionID]
+	s.mu.Unlock()
+	if !ok {
+		return sess, fmt.Errorf("session %s not found", sessionID)
+	}
+	err := json.Unmarshal(data, &sess)
+	if err != nil {
+		return sess, err
+	}
+	return checkExpiry(sess)
+}
+
+func (s memorySessionStore) Delete(sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sessionID)
+	return nil
+}
+
+func (s memorySessionStore) FetchExpired(now time.Time) ([]UserSession, error) {
+	return s.filter(func(sess UserSession) bool {
+		return sess.Expired(now)
+	})
+}
+
+func (s memorySessionStore) filter(keep func(UserSession) bool) ([]UserSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []UserSession
+	for _, data := range s.sessions {
+		var sess UserSession
+		err := json.Unmarshal(data, &sess)
+		if err != nil {
+			return nil, err
+		}
+		if keep(sess) {
+			out = append(out, sess)
+		}
+	}
+	return out, nil
+}
+
+type fileSessionStore struct {
+	dir string
+}
+
+// NewFileSessionStore keeps each session as a json file in dir
+func NewFileSessionStore(dir string) (SessionStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fileSessionStore{}, err
+	}
+	return fileSessionStore{dir: dir}, nil
+}
+
+func (s fileSessionStore) path(sessionID string) (string, error) {
+	if sessionID == "" || strings.ContainsAny(sessionID, "/\\.") {
+		return "", fmt.Errorf("invalid session id %q", sessionID)
+	}
+	return filepath.Join(s.dir, sessionID+".json"), nil
+}
+
+func (s fileSessionStore) Create(usess UserSession) error {
+	path, err := s.path(usess.Uid)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(usess)
+	if err != nil {
+		return fmt.Errorf("failed to encode json %v", err)
+	}
+
+	// write to a temp file first so a crash never leaves half a session
+	tmp, err := ioutil.TempFile(s.dir, "session")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s fileSessionStore) FetchByID(sessionID string) (UserSession, error) {
+	var sess UserSession
+	path, err := s.path(sessionID)
+	if err != nil {
+		return sess, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return sess, err
+	}
+	err = json.Unmarshal(data, &sess)
+	if err != nil {
+		return sess, err
+	}
+	return checkExpiry(sess)
+}
+
+func (s fileSessionStore) Delete(sessionID string) error {
+	path, err := s.path(sessionID)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s fileSessionStore) FetchExpired(now time.Time) ([]UserSession, error) {
+	return s.filter(func(sess UserSession) bool {
+		return sess.Expired(now)
+	})
+}
+
+// filter reads every session file and returns those matching keep, files
+// that can not be read are logged and skipped
+func (s fileSessionStore) filter(keep func(UserSession) bool) ([]UserSession, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var out []UserSession
+	for _, path := range paths {
+		var sess UserSession
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("failed to read session [%s][%s]", path, err.Error())
+			continue
+		}
+		err = json.Unmarshal(data, &sess)
+		if err != nil {
+			log.Printf("failed to decode session [%s][%s]", path, err.Error())
+			continue
+		}
+		if keep(sess) {
+			out = append(out, sess)
+		}
+	}
+	return out, nil
+}
+
+type sqliteSessionStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteSessionStore keeps sessions in a sqlite database at path,
+// creating it if needed
+func NewSQLiteSessionStore(path string) (SessionStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return sqliteSessionStore{}, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		data TEXT NOT NULL,
+		expires_at INTEGER NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		db.Close()
+		return sqliteSessionStore{}, err
+	}
+	return sqliteSessionStore{db: db}, nil
+}
+
+func (s sqliteSessionStore) Create(usess UserSession) error {
+	data, err := json.Marshal(usess)
+	if err != nil {
+		return fmt.Errorf("failed to encode json %v", err)
+	}
+	_, err = s.db.Exec(
+		"INSERT OR REPLACE INTO sessions (id, data, expires_at) VALUES (?, ?, ?)",
+		usess.Uid,
+		string(data),
+		usess.ExpiresAt.Unix(),
+	)
+	return err
+}
+
+func (s sqliteSessionStore) FetchByID(sessionID string) (UserSession, error) {
+	var sess UserSession
+	var data string
+	err := s.db.QueryRow("SELECT data FROM sessions WHERE id = ?", sessionID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return sess, fmt.Errorf("session %s not found", sessionID)
+	}
+	if err != nil {
+		return sess, err
+	}
+	err = json.Unmarshal([]byte(data), &sess)
+	if err != nil {
+		return sess, err
+	}
+	return checkExpiry(sess)
+}
+
+func (s sqliteSessionStore) Delete(sessionID string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", sessionID)
+	return err
+}
+
+func (s sqliteSessionStore) FetchExpired(now time.Time) ([]UserSession, error) {
+	return s.query("SELECT id, data FROM sessions WHERE expires_at <= ?", now.Unix())
+}
+
+// query returns the sessions selected by query, rows that can not be
+// decoded are logged and skipped
+func (s sqliteSessionStore) query(query string, args ...interface{}) ([]UserSession, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []UserSession
+	for rows.Next() {
+		var sess UserSession
+		var id, data string
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(data), &sess)
+		if err != nil {
+			log.Printf("failed to decode session [%s][%s]", id, err.Error())
+			continue
+		}
+		out = append(out, sess)
+	}
+	return out, rows.Err()
 }
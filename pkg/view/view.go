@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/j4y_funabashi/inari-admin/pkg/okami"
+	"github.com/j4y_funabashi/inari-admin/pkg/session"
 )
 
 const (
@@ -37,6 +38,8 @@ type ListMediaView struct {
 	AfterKey     string
 	HasPaging    bool
 	PageTitle    string
+	CSRFToken    string
+	Accounts     session.Accounts
 	MediaDays    []MediaDay
 }
 
@@ -77,7 +80,7 @@ func (media MediaItem) HasLocation() bool {
 	return media.Lat > 0 || media.Lng > 0
 }
 
-func RenderMediaPreview(media MediaItem, outBuf *bytes.Buffer) error {
+func RenderMediaPreview(media MediaItem, accounts session.Accounts, csrfToken string, outBuf *bytes.Buffer) error {
 
 	t, err := template.ParseFiles(
 		"view/components.html",
@@ -90,9 +93,13 @@ func RenderMediaPreview(media MediaItem, outBuf *bytes.Buffer) error {
 	v := struct {
 		PageTitle string
 		Media     MediaItem
+		CSRFToken string
+		Accounts  session.Accounts
 	}{
 		PageTitle: "Choose a Video/Photo",
 		Media:     media,
+		CSRFToken: csrfToken,
+		Accounts:  accounts,
 	}
 	err = t.ExecuteTemplate(outBuf, "layout", v)
 	return err
@@ -282,6 +289,8 @@ type MediaDayView struct {
 	Media        []Media
 	MediaGrid    [][]Media
 	PageTitle    string
+	CSRFToken    string
+	Accounts     session.Accounts
 }
 
 func ParseMediaDayView(mediaResponse okami.ListMediaResponse, selectedDay string) MediaDayView {
@@ -303,9 +312,11 @@ func ParseMediaDayView(mediaResponse okami.ListMediaResponse, selectedDay string
 	}
 }
 
-func RenderMediaDay(mediaResponse okami.ListMediaResponse, selectedDay string, outBuf *bytes.Buffer) error {
+func RenderMediaDay(mediaResponse okami.ListMediaResponse, selectedDay string, accounts session.Accounts, csrfToken string, outBuf *bytes.Buffer) error {
 
 	viewModel := ParseMediaDayView(mediaResponse, selectedDay)
+	viewModel.CSRFToken = csrfToken
+	viewModel.Accounts = accounts
 
 	t, err := template.ParseFiles(
 		"view/components.html",
@@ -320,9 +331,11 @@ func RenderMediaDay(mediaResponse okami.ListMediaResponse, selectedDay string, o
 	return err
 }
 
-func RenderMediaList(mediaResponse okami.ListMediaResponse, outBuf *bytes.Buffer) error {
+func RenderMediaList(mediaResponse okami.ListMediaResponse, accounts session.Accounts, csrfToken string, outBuf *bytes.Buffer) error {
 
 	viewModel := ParseListMediaView(mediaResponse)
+	viewModel.CSRFToken = csrfToken
+	viewModel.Accounts = accounts
 
 	t, err := template.ParseFiles(
 		"view/components.html",